@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/burningsunrise/tplink-exporter/config"
+	"github.com/burningsunrise/tplink-exporter/parser"
+)
+
+// checkConfig runs tplink-exporter check-config, which reports every problem
+// in the configuration file without starting the exporter, and returns the
+// exit code
+func checkConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configFile := flags.String("config", envOr("TPLINK_CONFIG", parser.DefaultConfigFile),
+		"path of the configuration file, env TPLINK_CONFIG")
+	envFile := flags.String("env-file", envOr("TPLINK_ENV_FILE", config.EnvFile),
+		"path of the env file holding USER and PASSWORD, env TPLINK_ENV_FILE")
+	flags.Parse(args)
+	config.EnvFile = *envFile
+
+	problems, err := parser.CheckConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, p := range problems {
+		if p.Line > 0 {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", *configFile, p.Line, p.Message)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *configFile, p.Message)
+		}
+	}
+	if len(problems) > 0 {
+		noun := "problems"
+		if len(problems) == 1 {
+			noun = "problem"
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d %s found\n", *configFile, len(problems), noun)
+		return 1
+	}
+	fmt.Printf("%s: OK\n", *configFile)
+	return 0
+}
@@ -1,245 +1,392 @@
 package collector
 
 import (
-	"fmt"
+	"context"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/burningsunrise/tplink-exporter/model"
 	"github.com/burningsunrise/tplink-exporter/parser"
 
-	"github.com/panjf2000/ants"
 	"github.com/prometheus/client_golang/prometheus"
-	log "github.com/sirupsen/logrus"
 )
 
 type tplinkCollector struct {
-	txPackets          *prometheus.Desc
-	rxPackets          *prometheus.Desc
-	speed              *prometheus.Desc
-	vlans              *prometheus.Desc
-	memory             *prometheus.Desc
-	cpu                *prometheus.Desc
-	rxBadPackets       *prometheus.Desc
-	txBadPackets       *prometheus.Desc
-	broadcastRxPackets *prometheus.Desc
-	broadcastTxPackets *prometheus.Desc
-	multicastTxPackets *prometheus.Desc
-	multicastRxPackets *prometheus.Desc
-	unicastTxPackets   *prometheus.Desc
-	unicastRxPackets   *prometheus.Desc
-	generalInfo        *prometheus.Desc
+	engine    *Engine
+	scheduler *Scheduler
+	ctx       context.Context
+	target    string
+	module    parser.Module
+	legacy    *legacyMetrics
+
+	// labelNames are appended to the labels of every metric, labels returns
+	// their values for a host
+	labelNames []string
+	labels     func(host string) map[string]string
+
+	portPackets    *prometheus.Desc
+	portErrors     *prometheus.Desc
+	portBytes      *prometheus.Desc
+	portFrameSizes *prometheus.Desc
+	portUndersize  *prometheus.Desc
+	portOversize   *prometheus.Desc
+	portSpeed      *prometheus.Desc
+	portSpeedCfg   *prometheus.Desc
+	portUp         *prometheus.Desc
+	portAdminUp    *prometheus.Desc
+	portDuplex     *prometheus.Desc
+	portFlowCtrl   *prometheus.Desc
+	portMedia      *prometheus.Desc
+	portVlan       *prometheus.Desc
+	memory         *prometheus.Desc
+	cpu            *prometheus.Desc
+	temperature    *prometheus.Desc
+	info           *prometheus.Desc
+	lastPoll       *prometheus.Desc
+	up             *prometheus.Desc
+	scrapeDuration *prometheus.Desc
+	scrapeErrors   *prometheus.Desc
+	stageSuccess   *prometheus.Desc
+}
+
+// deviceCollector serves the devices cached by the scheduler. The names of
+// the device labels change when the configuration is reloaded, so it is an
+// unchecked collector that rebuilds its metric descriptions when they do
+type deviceCollector struct {
+	scheduler *Scheduler
+	legacy    bool
+	mu        sync.Mutex
+	collector *tplinkCollector
+}
+
+// NewTplinkCollector returns a collector serving the devices cached by
+// scheduler, every metric gets the labels of its device. legacy also exports
+// the metric names used before the tplink_ namespace was introduced
+func NewTplinkCollector(scheduler *Scheduler, legacy bool) prometheus.Collector {
+	return &deviceCollector{scheduler: scheduler, legacy: legacy}
 }
 
-func NewTplinkCollector() *tplinkCollector {
-	return &tplinkCollector{
-		txPackets: prometheus.NewDesc("port_tx_metric",
-			"Shows tx packets on the hosts port",
-			[]string{"portnum", "host"}, nil,
-		),
-		rxPackets: prometheus.NewDesc("port_rx_metric",
-			"Shows rx packets on the hosts port",
-			[]string{"portnum", "host"}, nil,
-		),
-		speed: prometheus.NewDesc("port_speed_metric",
-			"Shows the hosts port speed",
-			[]string{"portnum", "host"}, nil,
-		),
-		vlans: prometheus.NewDesc("port_vlans_metric",
-			"Shows the vlans on port number",
-			[]string{"vlanname", "vlanid", "host", "port"}, nil),
-		memory: prometheus.NewDesc("switch_memory_metric",
-			"Shows the specific switch memory",
-			[]string{"host", "macaddress"}, nil),
-		cpu: prometheus.NewDesc("switch_cpu_metric",
-			"Shows the specific switch cpu",
-			[]string{"host", "macaddress"}, nil),
-		rxBadPackets: prometheus.NewDesc("port_badrx_metric",
-			"Shows bad rx packets on the hosts port",
-			[]string{"portnum", "host"}, nil),
-		txBadPackets: prometheus.NewDesc("port_badtx_metric",
-			"Shows bad tx packets on the hosts port",
-			[]string{"portnum", "host"}, nil),
-		broadcastRxPackets: prometheus.NewDesc("port_broadcastrx_metric",
-			"Shows broadcast rx packets the hosts port",
-			[]string{"portnum", "host"}, nil),
-		broadcastTxPackets: prometheus.NewDesc("port_broadcasttx_metric",
-			"Shows broadcast tx packets on the hosts port",
-			[]string{"portnum", "host"}, nil),
-		multicastTxPackets: prometheus.NewDesc("port_multicasttx_metric",
-			"Shows multicast tx packets on the hosts port",
-			[]string{"portnum", "host"}, nil),
-		multicastRxPackets: prometheus.NewDesc("port_multicastrx_metric",
-			"Shows multicast rx packets on the hosts port",
-			[]string{"portnum", "host"}, nil),
-		unicastTxPackets: prometheus.NewDesc("port_unicasttx_metric",
-			"Shows unicast tx packets on the hosts port",
-			[]string{"portnum", "host"}, nil),
-		unicastRxPackets: prometheus.NewDesc("port_unicastrx_metric",
-			"Shows unicast rx packets on the hosts port",
-			[]string{"portnum", "host"}, nil),
-		generalInfo: prometheus.NewDesc("switch_generalinfo_metric",
-			"Shows general information about the switch with temperature as a metric",
-			[]string{"devloc", "sysdesc", "host", "hwversion", "fmversion", "macaddress",
-				"systime", "runtime", "serialnum"}, nil),
+func (c *deviceCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	labelNames := c.scheduler.LabelNames()
+	c.mu.Lock()
+	if c.collector == nil || !reflect.DeepEqual(c.collector.labelNames, labelNames) {
+		c.collector = newTplinkCollector(labelNames, c.legacy)
+		c.collector.labels = c.scheduler.Labels
+		c.collector.engine = c.scheduler.engine
+		c.collector.scheduler = c.scheduler
+	}
+	collector := c.collector
+	c.mu.Unlock()
+	collector.Collect(ch)
+}
+
+// NewTplinkProbeCollector returns a collector that only probes target on
+// engine, logging in with the credentials of module and adding labels to
+// every metric, the probe is aborted when ctx is done
+func NewTplinkProbeCollector(ctx context.Context, engine *Engine, target string, module parser.Module,
+	labels map[string]string, legacy bool) *tplinkCollector {
+	labelNames := make([]string, 0, len(labels))
+	for name := range labels {
+		labelNames = append(labelNames, name)
 	}
+	sort.Strings(labelNames)
+
+	collector := newTplinkCollector(labelNames, legacy)
+	collector.labels = func(string) map[string]string { return labels }
+	collector.engine = engine
+	collector.ctx = ctx
+	collector.target = target
+	collector.module = module
+	return collector
 }
 
+func newTplinkCollector(labelNames []string, legacy bool) *tplinkCollector {
+	labels := func(names ...string) []string {
+		return append(names, labelNames...)
+	}
+	collector := &tplinkCollector{
+		labelNames: labelNames,
+		portPackets: prometheus.NewDesc("tplink_port_packets_total",
+			"Number of good packets sent or received on the port by type",
+			labels("host", "unit", "slot", "port", "direction", "type"), nil),
+		portErrors: prometheus.NewDesc("tplink_port_errors_total",
+			"Number of bad packets sent or received on the port",
+			labels("host", "unit", "slot", "port", "direction"), nil),
+		portBytes: prometheus.NewDesc("tplink_port_bytes_total",
+			"Number of bytes sent or received on the port",
+			labels("host", "unit", "slot", "port", "direction"), nil),
+		portFrameSizes: prometheus.NewDesc("tplink_port_frame_size_packets_total",
+			"Number of packets on the port by frame size in bytes",
+			labels("host", "unit", "slot", "port", "size"), nil),
+		portUndersize: prometheus.NewDesc("tplink_port_undersize_packets_total",
+			"Number of received packets shorter than 64 bytes",
+			labels("host", "unit", "slot", "port"), nil),
+		portOversize: prometheus.NewDesc("tplink_port_oversize_packets_total",
+			"Number of packets sent or received that were longer than the maximum frame size",
+			labels("host", "unit", "slot", "port", "direction"), nil),
+		portSpeed: prometheus.NewDesc("tplink_port_speed_bits_per_second",
+			"Negotiated link speed of the port, 0 when the link is down and -1 when unknown",
+			labels("host", "unit", "slot", "port"), nil),
+		portSpeedCfg: prometheus.NewDesc("tplink_port_configured_speed_bits_per_second",
+			"Configured speed of the port, 0 for auto negotiation and -1 when unknown",
+			labels("host", "unit", "slot", "port"), nil),
+		portUp: prometheus.NewDesc("tplink_port_up",
+			"Whether the port has a link",
+			labels("host", "unit", "slot", "port"), nil),
+		portAdminUp: prometheus.NewDesc("tplink_port_admin_up",
+			"Whether the port is enabled in the switch configuration",
+			labels("host", "unit", "slot", "port"), nil),
+		portDuplex: prometheus.NewDesc("tplink_port_duplex_info",
+			"Negotiated and configured duplex mode of the port",
+			labels("host", "unit", "slot", "port", "duplex", "configured"), nil),
+		portFlowCtrl: prometheus.NewDesc("tplink_port_flow_control_enabled",
+			"Whether flow control is enabled on the port",
+			labels("host", "unit", "slot", "port"), nil),
+		portMedia: prometheus.NewDesc("tplink_port_media_info",
+			"Media type of the port",
+			labels("host", "unit", "slot", "port", "media"), nil),
+		portVlan: prometheus.NewDesc("tplink_port_vlan_info",
+			"VLANs the port is a member of",
+			labels("host", "unit", "slot", "port", "vlan_id", "vlan_name"), nil),
+		memory: prometheus.NewDesc("tplink_memory_usage_percent",
+			"Memory usage of the switch",
+			labels("host", "unit"), nil),
+		cpu: prometheus.NewDesc("tplink_cpu_usage_percent",
+			"CPU usage of the switch",
+			labels("host", "unit"), nil),
+		temperature: prometheus.NewDesc("tplink_temperature_celsius",
+			"Temperature of the switch",
+			labels("host", "unit"), nil),
+		info: prometheus.NewDesc("tplink_switch_info",
+			"Hardware and firmware information about the switch",
+			labels("host", "unit", "description", "location", "hardware_version", "firmware_version",
+				"mac_address", "serial_number"), nil),
+		lastPoll: prometheus.NewDesc("tplink_last_poll_timestamp_seconds",
+			"Unix time of the last successful poll of the switch",
+			labels("host"), nil),
+		up: prometheus.NewDesc("tplink_up",
+			"Whether the switch could be logged in to and answered on the last poll",
+			labels("host"), nil),
+		scrapeDuration: prometheus.NewDesc("tplink_scrape_duration_seconds",
+			"How long each API stage of the last poll of the switch took",
+			labels("host", "stage"), nil),
+		scrapeErrors: prometheus.NewDesc("tplink_scrape_errors_total",
+			"Number of times an API stage failed while polling the switch",
+			labels("host", "stage"), nil),
+		stageSuccess: prometheus.NewDesc("tplink_scrape_stage_success",
+			"Whether each API stage of the last poll of the switch succeeded",
+			labels("host", "stage"), nil),
+	}
+	if legacy {
+		collector.legacy = newLegacyMetrics()
+	}
+	return collector
+}
 
 func (collector *tplinkCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- collector.txPackets
-	ch <- collector.rxPackets
-	ch <- collector.speed
-	ch <- collector.vlans
+	ch <- collector.portPackets
+	ch <- collector.portErrors
+	ch <- collector.portBytes
+	ch <- collector.portFrameSizes
+	ch <- collector.portUndersize
+	ch <- collector.portOversize
+	ch <- collector.portSpeed
+	ch <- collector.portSpeedCfg
+	ch <- collector.portUp
+	ch <- collector.portAdminUp
+	ch <- collector.portDuplex
+	ch <- collector.portFlowCtrl
+	ch <- collector.portMedia
+	ch <- collector.portVlan
 	ch <- collector.memory
 	ch <- collector.cpu
-	ch <- collector.rxBadPackets
-	ch <- collector.txBadPackets
-	ch <- collector.broadcastRxPackets
-	ch <- collector.broadcastTxPackets
-	ch <- collector.unicastRxPackets
-	ch <- collector.unicastTxPackets
-	ch <- collector.multicastRxPackets
-	ch <- collector.multicastTxPackets
-	ch <- collector.generalInfo
+	ch <- collector.temperature
+	ch <- collector.info
+	ch <- collector.lastPoll
+	ch <- collector.up
+	ch <- collector.scrapeDuration
+	ch <- collector.scrapeErrors
+	ch <- collector.stageSuccess
+	if collector.legacy != nil {
+		collector.legacy.describe(ch)
+	}
 }
 
 func (collector *tplinkCollector) Collect(ch chan<- prometheus.Metric) {
-	collection := probeDevices()
-
-	for _, c := range collection {
-		ch <- prometheus.MustNewConstMetric(collector.memory, prometheus.GaugeValue, float64(c.Data.Memory[0]), c.DnsName,
-			c.Data.MacAddress)
-		ch <- prometheus.MustNewConstMetric(collector.cpu, prometheus.GaugeValue, float64(c.Data.Cpu[0]), c.DnsName,
-			c.Data.MacAddress)
-		ch <- prometheus.MustNewConstMetric(collector.generalInfo, prometheus.GaugeValue, float64(c.Data.Temperature),
-			c.Data.DevLoc, c.Data.SysDescription, c.DnsName, c.Data.HwVersion, c.Data.FwVersion, c.Data.MacAddress,
-			c.Data.SysTime, c.Data.RunTime, c.Data.SeNumber)
-		for _, p := range c.Ports {
-			port := strings.Split(p.Port, "/")[2]
-			var vlanName []string
-			var vlanId []float64
-			if num, err := strconv.ParseFloat(port, 64); err == nil {
-				ch <- prometheus.MustNewConstMetric(collector.rxPackets, prometheus.GaugeValue, float64(p.PktsRx),
-					port, c.DnsName)
-				ch <- prometheus.MustNewConstMetric(collector.txPackets, prometheus.GaugeValue, float64(p.PktsTx),
-					port, c.DnsName)
-				ch <- prometheus.MustNewConstMetric(collector.speed, prometheus.GaugeValue, float64(p.SpeedLink),
-					port, c.DnsName)
-				ch <- prometheus.MustNewConstMetric(collector.rxBadPackets, prometheus.GaugeValue, float64(p.ErrorsRx),
-					port, c.DnsName)
-				ch <- prometheus.MustNewConstMetric(collector.txBadPackets, prometheus.GaugeValue, float64(p.ErrorsTx),
-					port, c.DnsName)
-				ch <- prometheus.MustNewConstMetric(collector.broadcastRxPackets, prometheus.GaugeValue, float64(p.BroadcastRx),
-					port, c.DnsName)
-				ch <- prometheus.MustNewConstMetric(collector.broadcastTxPackets, prometheus.GaugeValue, float64(p.BroadcastTx),
-					port, c.DnsName)
-				ch <- prometheus.MustNewConstMetric(collector.unicastRxPackets, prometheus.GaugeValue, float64(p.UnicastRx),
-					port, c.DnsName)
-				ch <- prometheus.MustNewConstMetric(collector.unicastTxPackets, prometheus.GaugeValue, float64(p.UnicastTx),
-					port, c.DnsName)
-				ch <- prometheus.MustNewConstMetric(collector.multicastRxPackets, prometheus.GaugeValue, float64(p.MulticastRx),
-					port, c.DnsName)
-				ch <- prometheus.MustNewConstMetric(collector.multicastTxPackets, prometheus.GaugeValue, float64(p.MulticastTx),
-					port, c.DnsName)
-				// Vlans
-				for _, vl := range p.Vlans {
-					vlanName = append(vlanName, vl.Name)
-					vlanId = append(vlanId, vl.VlanID)
-				}
-				ch <- prometheus.MustNewConstMetric(collector.vlans, prometheus.GaugeValue, num, strings.Join(vlanName, ","),
-					strings.Trim(strings.Replace(fmt.Sprint(vlanId), " ", ",", -1), "[]"), c.DnsName, port)
-			}
+	var results []probeResult
+	var collection []snapshot
+	if collector.scheduler != nil {
+		results, collection = collector.scheduler.Results(), collector.scheduler.Snapshots()
+	} else {
+		results, collection = collector.probe()
+	}
+
+	for _, r := range results {
+		collector.collectStatus(ch, r)
+	}
+	for _, snap := range collection {
+		collector.collectDevice(ch, snap)
+		if collector.legacy != nil {
+			collector.legacy.collect(ch, snap)
 		}
 	}
 }
 
-func probeDevices() []model.Tplink {
-	y := parser.YamlConfig{}
-	y.GetConfig()
-
-	defer ants.Release()
-	var wg sync.WaitGroup
-	log.WithFields(log.Fields{
-		"status": "probing",
-	}).Info("scanning all devices")
-	collection := []model.Tplink{}
-	client := model.HttpClient()
-
-	p, _ := ants.NewPoolWithFunc(20, func(i interface{}) {
-		defer wg.Done()
-
-		tplink := model.Tplink{DnsName: i.(string)}
-
-		if err := tplink.Login(y, client); err != nil {
-			log.WithFields(log.Fields{
-				"login": i.(string),
-			}).Error(err)
-			return
+// collectDevice exports the data of every stage that succeeded in snap
+func (collector *tplinkCollector) collectDevice(ch chan<- prometheus.Metric, snap snapshot) {
+	c := snap.tplink
+	host := c.DnsName
+	ch <- collector.metric(collector.lastPoll, prometheus.GaugeValue,
+		float64(snap.timestamp.UnixNano())/1e9, host)
+	for _, u := range c.Units {
+		unit := strconv.Itoa(u.ID)
+		if !snap.failed["memory"] && len(u.Data.Memory) > 0 {
+			ch <- collector.metric(collector.memory, prometheus.GaugeValue, u.Data.Memory[0], host, unit)
 		}
-		if err := tplink.SwitchSystem(client); err != nil {
-			log.WithFields(log.Fields{
-				"switchsystem": i.(string),
-			}).Error(err)
-			return
+		if !snap.failed["cpu"] && len(u.Data.Cpu) > 0 {
+			ch <- collector.metric(collector.cpu, prometheus.GaugeValue, u.Data.Cpu[0], host, unit)
 		}
-		if err := tplink.SwitchPorts(client); err != nil {
-			log.WithFields(log.Fields{
-				"switchports": i.(string),
-			}).Error(err)
-			return
+		if !snap.failed["switchsystem"] {
+			ch <- collector.metric(collector.temperature, prometheus.GaugeValue, u.Data.Temperature,
+				host, unit)
+			ch <- collector.metric(collector.info, prometheus.GaugeValue, 1, host, unit,
+				u.Data.SysDescription, u.Data.DevLoc, u.Data.HwVersion, u.Data.FwVersion, u.Data.MacAddress,
+				u.Data.SeNumber)
 		}
-		if err := tplink.SwitchPortStatistics(client); err != nil {
-			log.WithFields(log.Fields{
-				"portstats": i.(string),
-			}).Error(err)
-			return
-		}
-		if err := tplink.SwitchPortVlans(client); err != nil {
-			log.WithFields(log.Fields{
-				"portvlans": i.(string),
-			}).Error(err)
-			return
-		}
-		if err := tplink.SwitchPortVlanCfg(client); err != nil {
-			log.WithFields(log.Fields{
-				"portvlancfg": i.(string),
-			}).Error(err)
-			return
-		}
-		if err := tplink.SwitchMacVlanCfgModel(client); err != nil {
-			log.WithFields(log.Fields{
-				"macvlancfg": i.(string),
-			}).Error(err)
-			return
+	}
+	for _, p := range c.Ports {
+		unit, slot, port, ok := parsePort(p.Port)
+		if !ok {
+			continue
 		}
-		if err := tplink.SwitchMemory(client); err != nil {
-			log.WithFields(log.Fields{
-				"memory": i.(string),
-			}).Error(err)
-			return
+		ch <- collector.metric(collector.portSpeed, prometheus.GaugeValue, c.LinkSpeed(p), host, unit, slot, port)
+		ch <- collector.metric(collector.portSpeedCfg, prometheus.GaugeValue, c.ConfiguredSpeed(p),
+			host, unit, slot, port)
+		ch <- collector.metric(collector.portUp, prometheus.GaugeValue, boolValue(p.Up()), host, unit, slot, port)
+		ch <- collector.metric(collector.portAdminUp, prometheus.GaugeValue, boolValue(p.AdminUp()),
+			host, unit, slot, port)
+		ch <- collector.metric(collector.portDuplex, prometheus.GaugeValue, 1, host, unit, slot, port,
+			p.Duplex(), p.ConfiguredDuplex())
+		ch <- collector.metric(collector.portFlowCtrl, prometheus.GaugeValue,
+			boolValue(p.FlowControlEnabled()), host, unit, slot, port)
+		ch <- collector.metric(collector.portMedia, prometheus.GaugeValue, 1, host, unit, slot, port, p.Media())
+		if !snap.failed["portstats"] {
+			for _, m := range []struct {
+				direction, kind string
+				value           float64
+			}{
+				{"rx", "unicast", p.UnicastRx},
+				{"rx", "multicast", p.MulticastRx},
+				{"rx", "broadcast", p.BroadcastRx},
+				{"tx", "unicast", p.UnicastTx},
+				{"tx", "multicast", p.MulticastTx},
+				{"tx", "broadcast", p.BroadcastTx},
+			} {
+				ch <- collector.metric(collector.portPackets, prometheus.CounterValue, m.value,
+					host, unit, slot, port, m.direction, m.kind)
+			}
+			ch <- collector.metric(collector.portErrors, prometheus.CounterValue, p.ErrorsRx,
+				host, unit, slot, port, "rx")
+			ch <- collector.metric(collector.portErrors, prometheus.CounterValue, p.ErrorsTx,
+				host, unit, slot, port, "tx")
+			ch <- collector.metric(collector.portBytes, prometheus.CounterValue, p.BytesRx,
+				host, unit, slot, port, "rx")
+			ch <- collector.metric(collector.portBytes, prometheus.CounterValue, p.BytesTx,
+				host, unit, slot, port, "tx")
+			for _, m := range []struct {
+				size  string
+				value float64
+			}{
+				{"64", p.Pkts64},
+				{"65-127", p.Pkts65},
+				{"128-255", p.Pkts128},
+				{"256-511", p.Pkts256},
+				{"512-1023", p.Pkts512},
+				{"1024-max", p.Pkts1023},
+			} {
+				ch <- collector.metric(collector.portFrameSizes, prometheus.CounterValue, m.value,
+					host, unit, slot, port, m.size)
+			}
+			ch <- collector.metric(collector.portUndersize, prometheus.CounterValue, p.UndersizePkts,
+				host, unit, slot, port)
+			ch <- collector.metric(collector.portOversize, prometheus.CounterValue, p.OversizePktsRx,
+				host, unit, slot, port, "rx")
+			ch <- collector.metric(collector.portOversize, prometheus.CounterValue, p.OversizePktsTx,
+				host, unit, slot, port, "tx")
 		}
-		if err := tplink.SwitchCpu(client); err != nil {
-			log.WithFields(log.Fields{
-				"cpu": i.(string),
-			}).Error(err)
-			return
+		if !snap.failed["portvlans"] {
+			for _, vl := range p.Vlans {
+				ch <- collector.metric(collector.portVlan, prometheus.GaugeValue, 1, host, unit, slot, port,
+					strconv.FormatFloat(vl.VlanID, 'f', -1, 64), vl.Name)
+			}
 		}
-		collection = append(collection, tplink)
-	})
+	}
+}
+
+// metric returns a const metric of desc, labels start with the host and the
+// values of the device labels are appended to them
+func (collector *tplinkCollector) metric(desc *prometheus.Desc, valueType prometheus.ValueType, value float64,
+	labels ...string) prometheus.Metric {
+	device := collector.labels(labels[0])
+	for _, name := range collector.labelNames {
+		labels = append(labels, device[name])
+	}
+	return prometheus.MustNewConstMetric(desc, valueType, value, labels...)
+}
 
-	defer p.Release()
-	for _, device := range y.Devices {
-		wg.Add(1)
-		_ = p.Invoke(device)
+func boolValue(b bool) float64 {
+	if b {
+		return 1
 	}
+	return 0
+}
+
+// parsePort splits a port name like 1/0/5 into its unit, slot and port
+func parsePort(name string) (unit, slot, port string, ok bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err != nil {
+			return "", "", "", false
+		}
+	}
+	return parts[0], parts[1], parts[2], true
+}
 
-	wg.Wait()
+func (collector *tplinkCollector) collectStatus(ch chan<- prometheus.Metric, r probeResult) {
+	host := r.tplink.DnsName
+	ch <- collector.metric(collector.up, prometheus.GaugeValue, boolValue(r.up), host)
+	for _, st := range r.stages {
+		ch <- collector.metric(collector.stageSuccess, prometheus.GaugeValue,
+			boolValue(st.err == nil && !st.skipped), host, st.name)
+		if !st.skipped {
+			ch <- collector.metric(collector.scrapeDuration, prometheus.GaugeValue,
+				st.duration.Seconds(), host, st.name)
+		}
+	}
+	errors := collector.engine.errors.get(host)
+	for _, name := range stageNames {
+		ch <- collector.metric(collector.scrapeErrors, prometheus.CounterValue,
+			errors[name], host, name)
+	}
+}
 
-	log.WithFields(log.Fields{
-		"devices": len(y.Devices),
-		"status":  "finished",
-	}).Info("waiting for next iteration")
-	return collection
+// probe scrapes the collectors target live, used by /probe
+func (collector *tplinkCollector) probe() ([]probeResult, []snapshot) {
+	var collection []snapshot
+	now := time.Now()
+	results := collector.engine.Probe(collector.ctx, collector.module, []string{collector.target})
+	for _, r := range results {
+		if r.up {
+			collection = append(collection, snapshot{tplink: r.tplink, timestamp: now, failed: r.failed()})
+		}
+	}
+	return results, collection
 }
@@ -0,0 +1,131 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/burningsunrise/tplink-exporter/fakeswitch"
+	"github.com/burningsunrise/tplink-exporter/parser"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const fixtures = "../fakeswitch/fixtures/synthetic-standalone"
+
+var credentials = parser.Module{User: "admin", Password: "secret"}
+
+// newTestEngine returns an engine that is stopped when the test ends
+func newTestEngine(t *testing.T) *Engine {
+	t.Helper()
+	engine, err := NewEngine(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(engine.pool.Release)
+	return engine
+}
+
+func TestProbeCollector(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+	host := fake.Host()
+
+	expected := fmt.Sprintf(`
+# HELP tplink_up Whether the switch could be logged in to and answered on the last poll
+# TYPE tplink_up gauge
+tplink_up{host="%[1]s"} 1
+# HELP tplink_cpu_usage_percent CPU usage of the switch
+# TYPE tplink_cpu_usage_percent gauge
+tplink_cpu_usage_percent{host="%[1]s",unit="1"} 7
+# HELP tplink_port_speed_bits_per_second Negotiated link speed of the port, 0 when the link is down and -1 when unknown
+# TYPE tplink_port_speed_bits_per_second gauge
+tplink_port_speed_bits_per_second{host="%[1]s",port="1",slot="0",unit="1"} 1e+09
+tplink_port_speed_bits_per_second{host="%[1]s",port="2",slot="0",unit="1"} 1e+08
+tplink_port_speed_bits_per_second{host="%[1]s",port="25",slot="0",unit="1"} 1e+09
+tplink_port_speed_bits_per_second{host="%[1]s",port="26",slot="0",unit="1"} 0
+tplink_port_speed_bits_per_second{host="%[1]s",port="3",slot="0",unit="1"} -1
+tplink_port_speed_bits_per_second{host="%[1]s",port="4",slot="0",unit="1"} 0
+# HELP tplink_port_vlan_info VLANs the port is a member of
+# TYPE tplink_port_vlan_info gauge
+tplink_port_vlan_info{host="%[1]s",port="1",slot="0",unit="1",vlan_id="1",vlan_name="System-VLAN"} 1
+tplink_port_vlan_info{host="%[1]s",port="1",slot="0",unit="1",vlan_id="10",vlan_name="servers"} 1
+tplink_port_vlan_info{host="%[1]s",port="2",slot="0",unit="1",vlan_id="20",vlan_name="printers"} 1
+tplink_port_vlan_info{host="%[1]s",port="25",slot="0",unit="1",vlan_id="1",vlan_name="System-VLAN"} 1
+tplink_port_vlan_info{host="%[1]s",port="26",slot="0",unit="1",vlan_id="1",vlan_name="System-VLAN"} 1
+tplink_port_vlan_info{host="%[1]s",port="3",slot="0",unit="1",vlan_id="1",vlan_name="System-VLAN"} 1
+tplink_port_vlan_info{host="%[1]s",port="4",slot="0",unit="1",vlan_id="1",vlan_name="System-VLAN"} 1
+`, host)
+
+	collector := NewTplinkProbeCollector(context.Background(), newTestEngine(t), host, credentials, nil, false)
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"tplink_up", "tplink_cpu_usage_percent", "tplink_port_speed_bits_per_second", "tplink_port_vlan_info")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProbeCollectorLoginFailure(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+	host := fake.Host()
+
+	expected := fmt.Sprintf(`
+# HELP tplink_up Whether the switch could be logged in to and answered on the last poll
+# TYPE tplink_up gauge
+tplink_up{host="%[1]s"} 0
+# HELP tplink_scrape_stage_success Whether each API stage of the last poll of the switch succeeded
+# TYPE tplink_scrape_stage_success gauge
+tplink_scrape_stage_success{host="%[1]s",stage="cpu"} 0
+tplink_scrape_stage_success{host="%[1]s",stage="login"} 0
+tplink_scrape_stage_success{host="%[1]s",stage="macvlancfg"} 0
+tplink_scrape_stage_success{host="%[1]s",stage="memory"} 0
+tplink_scrape_stage_success{host="%[1]s",stage="portstats"} 0
+tplink_scrape_stage_success{host="%[1]s",stage="portvlancfg"} 0
+tplink_scrape_stage_success{host="%[1]s",stage="portvlans"} 0
+tplink_scrape_stage_success{host="%[1]s",stage="switchports"} 0
+tplink_scrape_stage_success{host="%[1]s",stage="switchsystem"} 0
+`, host)
+
+	collector := NewTplinkProbeCollector(context.Background(), newTestEngine(t), host, parser.Module{User: "admin", Password: "wrong"}, nil, false)
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"tplink_up", "tplink_scrape_stage_success", "tplink_cpu_usage_percent")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProbeCollectorBrokenResponse(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+	fake.Replace("trafficMonitorCfgDetailModel_1-0-2.json", `{"data":"unexpected","success":true}`)
+	host := fake.Host()
+
+	expected := fmt.Sprintf(`
+# HELP tplink_up Whether the switch could be logged in to and answered on the last poll
+# TYPE tplink_up gauge
+tplink_up{host="%[1]s"} 1
+# HELP tplink_scrape_errors_total Number of times an API stage failed while polling the switch
+# TYPE tplink_scrape_errors_total counter
+tplink_scrape_errors_total{host="%[1]s",stage="cpu"} 0
+tplink_scrape_errors_total{host="%[1]s",stage="login"} 0
+tplink_scrape_errors_total{host="%[1]s",stage="macvlancfg"} 0
+tplink_scrape_errors_total{host="%[1]s",stage="memory"} 0
+tplink_scrape_errors_total{host="%[1]s",stage="portstats"} 1
+tplink_scrape_errors_total{host="%[1]s",stage="portvlancfg"} 0
+tplink_scrape_errors_total{host="%[1]s",stage="portvlans"} 0
+tplink_scrape_errors_total{host="%[1]s",stage="switchports"} 0
+tplink_scrape_errors_total{host="%[1]s",stage="switchsystem"} 0
+# HELP tplink_cpu_usage_percent CPU usage of the switch
+# TYPE tplink_cpu_usage_percent gauge
+tplink_cpu_usage_percent{host="%[1]s",unit="1"} 7
+`, host)
+
+	collector := NewTplinkProbeCollector(context.Background(), newTestEngine(t), host, credentials, nil, false)
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"tplink_up", "tplink_scrape_errors_total", "tplink_cpu_usage_percent")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,315 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/burningsunrise/tplink-exporter/model"
+	"github.com/burningsunrise/tplink-exporter/parser"
+
+	"github.com/panjf2000/ants"
+	log "github.com/sirupsen/logrus"
+)
+
+// stage is one API call made while probing a switch, when a required stage
+// fails or the context is done the remaining stages are skipped
+type stage struct {
+	name     string
+	required bool
+	run      func(t *model.Tplink, ctx context.Context, api model.SwitchAPI) error
+}
+
+// stageResult records how long a stage took and why it failed
+type stageResult struct {
+	name     string
+	duration time.Duration
+	err      error
+	skipped  bool
+}
+
+// probeResult is the outcome of probing a single device, up is true when
+// every required stage succeeded and the switch answered after login
+type probeResult struct {
+	tplink model.Tplink
+	up     bool
+	stages []stageResult
+}
+
+// failed returns the stages that failed or were skipped
+func (r probeResult) failed() map[string]bool {
+	failed := map[string]bool{}
+	for _, st := range r.stages {
+		if st.err != nil || st.skipped {
+			failed[st.name] = true
+		}
+	}
+	return failed
+}
+
+// answered reports whether a stage after login got an answer from the switch
+func (r probeResult) answered() bool {
+	for _, st := range r.stages {
+		if st.name != loginStage && !st.skipped && !model.Unreachable(st.err) {
+			return true
+		}
+	}
+	return false
+}
+
+// Engine probes devices on a worker pool that lives as long as the exporter,
+// it is shared by the background poller and /probe. Web sessions and error
+// counts are kept per switch across probes, as is the client limiting the
+// requests in flight to the switch
+type Engine struct {
+	pool     *ants.PoolWithFunc
+	slots    chan struct{}
+	client   *http.Client
+	sessions *model.SessionManager
+	errors   *errorTotals
+	mu       sync.Mutex
+	clients  map[string]*model.Client
+}
+
+// probeJob is a device handed to a worker, done is called with the result
+type probeJob struct {
+	ctx    context.Context
+	module parser.Module
+	target string
+	done   func(probeResult)
+}
+
+// NewEngine starts an engine probing at most size devices at once
+func NewEngine(size int) (*Engine, error) {
+	e := &Engine{
+		client:   model.HttpClient(),
+		sessions: model.NewSessionManager(),
+		errors:   &errorTotals{counts: map[string]map[string]float64{}},
+		clients:  map[string]*model.Client{},
+		slots:    make(chan struct{}, size),
+	}
+	pool, err := ants.NewPoolWithFunc(size, e.work)
+	if err != nil {
+		return nil, err
+	}
+	e.pool = pool
+	return e, nil
+}
+
+// Close logs out of every switch and stops the workers, call it on shutdown
+func (e *Engine) Close(ctx context.Context) {
+	e.sessions.LogoutAll(ctx)
+	e.pool.Release()
+}
+
+func (e *Engine) work(i interface{}) {
+	job := i.(probeJob)
+	result := e.probeDevice(job.ctx, job.module, job.target)
+	// free before done, so whoever done wakes up finds a free worker
+	<-e.slots
+	job.done(result)
+}
+
+// errBusy is returned by trySubmit when every worker is busy
+var errBusy = errors.New("every worker is busy")
+
+// submit probes target on the next free worker and calls done with the
+// result. It waits while every worker is busy and gives up with the error of
+// ctx when ctx is done first
+func (e *Engine) submit(ctx context.Context, module parser.Module, target string, done func(probeResult)) error {
+	select {
+	case e.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return e.invoke(probeJob{ctx: ctx, module: module, target: target, done: done})
+}
+
+// trySubmit is submit without waiting, it returns errBusy right away when
+// every worker is busy
+func (e *Engine) trySubmit(ctx context.Context, module parser.Module, target string, done func(probeResult)) error {
+	select {
+	case e.slots <- struct{}{}:
+	default:
+		return errBusy
+	}
+	return e.invoke(probeJob{ctx: ctx, module: module, target: target, done: done})
+}
+
+// invoke hands job to the pool, the caller holds a slot
+func (e *Engine) invoke(job probeJob) error {
+	// a slot was free, so a worker is or is about to become idle
+	err := e.pool.Invoke(job)
+	if err != nil {
+		<-e.slots
+	}
+	return err
+}
+
+// loginStage is the name of the stage logging in to the switch, it is the
+// only required stage
+const loginStage = "login"
+
+// dataStages read the data of a switch once logged in, in the order they run
+var dataStages = []stage{
+	{"switchsystem", false, (*model.Tplink).SwitchSystem},
+	{"switchports", false, (*model.Tplink).SwitchPorts},
+	{"portstats", false, (*model.Tplink).SwitchPortStatistics},
+	{"portvlans", false, (*model.Tplink).SwitchPortVlans},
+	{"portvlancfg", false, (*model.Tplink).SwitchPortVlanCfg},
+	{"macvlancfg", false, (*model.Tplink).SwitchMacVlanCfgModel},
+	{"memory", false, (*model.Tplink).SwitchMemory},
+	{"cpu", false, (*model.Tplink).SwitchCpu},
+}
+
+// stageNames are the names of every stage of a probe in the order they run
+var stageNames = func() []string {
+	names := []string{loginStage}
+	for _, st := range dataStages {
+		names = append(names, st.name)
+	}
+	return names
+}()
+
+func (e *Engine) deviceStages(module parser.Module) []stage {
+	login := stage{loginStage, true, func(t *model.Tplink, ctx context.Context, api model.SwitchAPI) error {
+		return e.sessions.Login(ctx, t, api, module)
+	}}
+	return append([]stage{login}, dataStages...)
+}
+
+// Probe probes every target on the worker pool and returns once all of them
+// are done, requests still outstanding when ctx is done are aborted
+func (e *Engine) Probe(ctx context.Context, module parser.Module, targets []string) []probeResult {
+	log.WithFields(log.Fields{
+		"status": "probing",
+	}).Info("scanning all devices")
+
+	results := make(chan probeResult, len(targets))
+	done := func(r probeResult) { results <- r }
+	for _, device := range targets {
+		if err := e.submit(ctx, module, device, done); err != nil {
+			// no worker was free before the deadline, the switch could not be
+			// logged in to
+			e.errors.inc(device, loginStage)
+			log.WithFields(log.Fields{
+				"probe": device,
+			}).Error(err)
+			results <- probeResult{
+				tplink: model.Tplink{DnsName: device},
+				stages: []stageResult{{name: loginStage, err: err}},
+			}
+		}
+	}
+
+	collection := make([]probeResult, 0, len(targets))
+	for range targets {
+		collection = append(collection, <-results)
+	}
+
+	log.WithFields(log.Fields{
+		"devices": len(targets),
+		"status":  "finished",
+	}).Info("waiting for next iteration")
+	return collection
+}
+
+// probeDevice runs every stage against target, the session is logged in again
+// once when the switch expired it
+func (e *Engine) probeDevice(ctx context.Context, module parser.Module, target string) probeResult {
+	api := e.api(target, module.MaxRequests)
+	result := probeResult{tplink: model.Tplink{DnsName: target}, up: true}
+	for i, st := range e.deviceStages(module) {
+		if !result.up || ctx.Err() != nil {
+			result.stages = append(result.stages, stageResult{name: st.name, skipped: true})
+			continue
+		}
+		start := time.Now()
+		err := runStage(st, &result.tplink, ctx, api)
+		if errors.Is(err, model.ErrSessionExpired) {
+			// the switch dropped our session, log in again and retry once
+			if err = e.sessions.Relogin(ctx, &result.tplink, api, module); err == nil {
+				err = runStage(st, &result.tplink, ctx, api)
+			}
+		}
+		result.stages = append(result.stages, stageResult{
+			name:     st.name,
+			duration: time.Since(start),
+			err:      err,
+		})
+		if err != nil {
+			e.errors.inc(target, st.name)
+			log.WithFields(log.Fields{
+				st.name: target,
+			}).Error(err)
+			if st.required {
+				result.up = false
+			}
+			if i == 1 && model.Unreachable(err) {
+				// a cached session logs in without contacting the switch, the
+				// first request after it is what tells that the switch is gone
+				e.sessions.Forget(api.Host(), result.tplink.Session)
+				result.up = false
+			}
+		}
+	}
+	return result
+}
+
+// api returns the client of target shared by every probe of it, so
+// maxRequests limits the requests to the switch and not to a single probe. A
+// new client is made when maxRequests was changed by a reload
+func (e *Engine) api(target string, maxRequests int) *model.Client {
+	if maxRequests < 1 {
+		maxRequests = 1
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	api, ok := e.clients[target]
+	if !ok || api.MaxRequests() != maxRequests {
+		api = model.NewClient(target, e.client, maxRequests)
+		e.clients[target] = api
+	}
+	return api
+}
+
+// runStage runs st and turns a panic into an error of the stage, so a worker
+// always returns a result
+func runStage(st stage, t *model.Tplink, ctx context.Context, api model.SwitchAPI) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return st.run(t, ctx, api)
+}
+
+// errorTotals counts failed stages per host for tplink_scrape_errors_total,
+// shared by the background poller and /probe
+type errorTotals struct {
+	mu     sync.Mutex
+	counts map[string]map[string]float64
+}
+
+func (e *errorTotals) inc(host, stage string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.counts[host] == nil {
+		e.counts[host] = map[string]float64{}
+	}
+	e.counts[host][stage]++
+}
+
+// get returns a copy of the error counts of host
+func (e *errorTotals) get(host string) map[string]float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	counts := make(map[string]float64, len(e.counts[host]))
+	for stage, count := range e.counts[host] {
+		counts[stage] = count
+	}
+	return counts
+}
@@ -0,0 +1,131 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/burningsunrise/tplink-exporter/fakeswitch"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestConcurrentProbes runs overlapping probes of several switches on one
+// engine, run it with -race
+func TestConcurrentProbes(t *testing.T) {
+	sets, err := os.ReadDir("../fakeswitch/fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	var fakes []*fakeswitch.Switch
+	for _, set := range sets {
+		fake := fakeswitch.NewFromDir(filepath.Join("../fakeswitch/fixtures", set.Name()),
+			credentials.User, credentials.Password)
+		defer fake.Close()
+		targets = append(targets, fake.Host())
+		fakes = append(fakes, fake)
+	}
+
+	// every probe starts cold, the engine has to share one login per switch
+	// instead of the probes logging each other out of the fake
+	engine := newTestEngine(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			results := engine.Probe(context.Background(), credentials, targets)
+			if len(results) != len(targets) {
+				t.Errorf("got %d results, want %d", len(results), len(targets))
+			}
+			for _, r := range results {
+				if !r.up || len(r.failed()) != 0 {
+					t.Errorf("%s: failed stages %v", r.tplink.DnsName, r.failed())
+				}
+			}
+		}()
+		go func(target string) {
+			defer wg.Done()
+			collector := NewTplinkProbeCollector(context.Background(), engine, target, credentials, nil, false)
+			if testutil.CollectAndCount(collector, "tplink_up") != 1 {
+				t.Errorf("%s: tplink_up missing", target)
+			}
+		}(targets[i%len(targets)])
+	}
+	wg.Wait()
+
+	engine.Close(context.Background())
+	for _, fake := range fakes {
+		if fake.Logins() != 1 || fake.Logouts() != 1 {
+			t.Errorf("%s: got %d logins and %d logouts, want 1 each", fake.Host(), fake.Logins(), fake.Logouts())
+		}
+	}
+}
+
+// TestProbesShareRequestLimit runs overlapping probes of one switch, together
+// they may not send more than max_requests requests to it at once
+func TestProbesShareRequestLimit(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+	fake.Delay(5 * time.Millisecond)
+
+	engine := newTestEngine(t)
+	module := credentials
+	module.MaxRequests = 1
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			engine.Probe(context.Background(), module, []string{fake.Host()})
+		}()
+	}
+	wg.Wait()
+
+	if peak := fake.PeakRequests(); peak != 1 {
+		t.Errorf("got %d requests at once, want 1", peak)
+	}
+}
+
+// TestProbeWaitsForWorkerUntilDeadline probes while every worker is busy, the
+// probe gives up at its deadline instead of waiting for a worker
+func TestProbeWaitsForWorkerUntilDeadline(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+	fake.Delay(time.Second)
+
+	engine, err := NewEngine(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	released := make(chan struct{})
+	if err := engine.submit(busy, credentials, fake.Host(), func(probeResult) { close(released) }); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		<-released
+		engine.pool.Release()
+	}()
+
+	ctx, stop := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer stop()
+	start := time.Now()
+	results := engine.Probe(ctx, credentials, []string{"other-switch"})
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("probe took %v, want it to give up at the deadline", took)
+	}
+	if len(results) != 1 || results[0].up {
+		t.Errorf("got %+v, want the probe to fail", results)
+	}
+	if errors := engine.errors.get("other-switch"); errors[loginStage] != 1 {
+		t.Errorf("got errors %v, want the failed login counted", errors)
+	}
+}
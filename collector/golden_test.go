@@ -0,0 +1,115 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/burningsunrise/tplink-exporter/fakeswitch"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// volatile metrics change on every run and are left out of the golden files
+var volatile = map[string]bool{
+	"tplink_last_poll_timestamp_seconds": true,
+	"tplink_scrape_duration_seconds":     true,
+}
+
+// TestGolden probes every fixture set in fakeswitch/fixtures and compares the
+// exposition text with testdata/<fixture set>.prom, run with -update after an
+// intended change of the output
+func TestGolden(t *testing.T) {
+	sets, err := ioutil.ReadDir("../fakeswitch/fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range sets {
+		if !set.IsDir() {
+			continue
+		}
+		name := set.Name()
+		t.Run(name, func(t *testing.T) {
+			fake := fakeswitch.NewFromDir(filepath.Join("../fakeswitch/fixtures", name),
+				credentials.User, credentials.Password)
+			defer fake.Close()
+
+			got := exposition(t, NewTplinkProbeCollector(context.Background(), newTestEngine(t), fake.Host(), credentials, nil, true))
+			got = bytes.ReplaceAll(got, []byte(fake.Host()), []byte("switch"))
+
+			golden := filepath.Join("testdata", name+".prom")
+			if *update {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v, run go test -update to create it", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s, run go test -update and review the diff\n%s",
+					golden, diff(string(want), string(got)))
+			}
+		})
+	}
+}
+
+// exposition renders everything collector exports in the text format
+func exposition(t *testing.T, collector prometheus.Collector) []byte {
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	for _, family := range families {
+		if volatile[family.GetName()] {
+			continue
+		}
+		if _, err := expfmt.MetricFamilyToText(&b, family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+// diff returns the lines only found in want or got
+func diff(want, got string) string {
+	wantLines := map[string]bool{}
+	for _, line := range strings.Split(want, "\n") {
+		wantLines[line] = true
+	}
+	gotLines := map[string]bool{}
+	for _, line := range strings.Split(got, "\n") {
+		gotLines[line] = true
+	}
+
+	var b strings.Builder
+	for _, line := range strings.Split(want, "\n") {
+		if !gotLines[line] {
+			b.WriteString("- " + line + "\n")
+		}
+	}
+	for _, line := range strings.Split(got, "\n") {
+		if !wantLines[line] {
+			b.WriteString("+ " + line + "\n")
+		}
+	}
+	return b.String()
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(m.Run())
+}
@@ -0,0 +1,172 @@
+package collector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/burningsunrise/tplink-exporter/model"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// legacyMetrics are the metric names exported before the tplink_ namespace,
+// they are kept so dashboards can be migrated gradually
+type legacyMetrics struct {
+	txPackets          *prometheus.Desc
+	rxPackets          *prometheus.Desc
+	speed              *prometheus.Desc
+	vlans              *prometheus.Desc
+	memory             *prometheus.Desc
+	cpu                *prometheus.Desc
+	rxBadPackets       *prometheus.Desc
+	txBadPackets       *prometheus.Desc
+	broadcastRxPackets *prometheus.Desc
+	broadcastTxPackets *prometheus.Desc
+	multicastTxPackets *prometheus.Desc
+	multicastRxPackets *prometheus.Desc
+	unicastTxPackets   *prometheus.Desc
+	unicastRxPackets   *prometheus.Desc
+	generalInfo        *prometheus.Desc
+}
+
+func newLegacyMetrics() *legacyMetrics {
+	return &legacyMetrics{
+		txPackets: prometheus.NewDesc("port_tx_metric",
+			"Shows tx packets on the hosts port",
+			[]string{"portnum", "host"}, nil,
+		),
+		rxPackets: prometheus.NewDesc("port_rx_metric",
+			"Shows rx packets on the hosts port",
+			[]string{"portnum", "host"}, nil,
+		),
+		speed: prometheus.NewDesc("port_speed_metric",
+			"Shows the hosts port speed",
+			[]string{"portnum", "host"}, nil,
+		),
+		vlans: prometheus.NewDesc("port_vlans_metric",
+			"Shows the vlans on port number",
+			[]string{"vlanname", "vlanid", "host", "port"}, nil),
+		memory: prometheus.NewDesc("switch_memory_metric",
+			"Shows the specific switch memory",
+			[]string{"host", "macaddress"}, nil),
+		cpu: prometheus.NewDesc("switch_cpu_metric",
+			"Shows the specific switch cpu",
+			[]string{"host", "macaddress"}, nil),
+		rxBadPackets: prometheus.NewDesc("port_badrx_metric",
+			"Shows bad rx packets on the hosts port",
+			[]string{"portnum", "host"}, nil),
+		txBadPackets: prometheus.NewDesc("port_badtx_metric",
+			"Shows bad tx packets on the hosts port",
+			[]string{"portnum", "host"}, nil),
+		broadcastRxPackets: prometheus.NewDesc("port_broadcastrx_metric",
+			"Shows broadcast rx packets the hosts port",
+			[]string{"portnum", "host"}, nil),
+		broadcastTxPackets: prometheus.NewDesc("port_broadcasttx_metric",
+			"Shows broadcast tx packets on the hosts port",
+			[]string{"portnum", "host"}, nil),
+		multicastTxPackets: prometheus.NewDesc("port_multicasttx_metric",
+			"Shows multicast tx packets on the hosts port",
+			[]string{"portnum", "host"}, nil),
+		multicastRxPackets: prometheus.NewDesc("port_multicastrx_metric",
+			"Shows multicast rx packets on the hosts port",
+			[]string{"portnum", "host"}, nil),
+		unicastTxPackets: prometheus.NewDesc("port_unicasttx_metric",
+			"Shows unicast tx packets on the hosts port",
+			[]string{"portnum", "host"}, nil),
+		unicastRxPackets: prometheus.NewDesc("port_unicastrx_metric",
+			"Shows unicast rx packets on the hosts port",
+			[]string{"portnum", "host"}, nil),
+		generalInfo: prometheus.NewDesc("switch_generalinfo_metric",
+			"Shows general information about the switch with temperature as a metric",
+			[]string{"devloc", "sysdesc", "host", "hwversion", "fmversion", "macaddress",
+				"systime", "runtime", "serialnum"}, nil),
+	}
+}
+
+func (legacy *legacyMetrics) describe(ch chan<- *prometheus.Desc) {
+	ch <- legacy.txPackets
+	ch <- legacy.rxPackets
+	ch <- legacy.speed
+	ch <- legacy.vlans
+	ch <- legacy.memory
+	ch <- legacy.cpu
+	ch <- legacy.rxBadPackets
+	ch <- legacy.txBadPackets
+	ch <- legacy.broadcastRxPackets
+	ch <- legacy.broadcastTxPackets
+	ch <- legacy.unicastRxPackets
+	ch <- legacy.unicastTxPackets
+	ch <- legacy.multicastRxPackets
+	ch <- legacy.multicastTxPackets
+	ch <- legacy.generalInfo
+}
+
+// collect exports the first unit of snap, the legacy names have no unit label
+// so the ports of other stack members would collide
+func (legacy *legacyMetrics) collect(ch chan<- prometheus.Metric, snap snapshot) {
+	c := snap.tplink
+	if len(c.Units) == 0 {
+		return
+	}
+	first := c.Units[0]
+	if !snap.failed["memory"] && len(first.Data.Memory) > 0 {
+		ch <- prometheus.MustNewConstMetric(legacy.memory, prometheus.GaugeValue, float64(first.Data.Memory[0]), c.DnsName,
+			first.Data.MacAddress)
+	}
+	if !snap.failed["cpu"] && len(first.Data.Cpu) > 0 {
+		ch <- prometheus.MustNewConstMetric(legacy.cpu, prometheus.GaugeValue, float64(first.Data.Cpu[0]), c.DnsName,
+			first.Data.MacAddress)
+	}
+	if !snap.failed["switchsystem"] {
+		ch <- prometheus.MustNewConstMetric(legacy.generalInfo, prometheus.GaugeValue, float64(first.Data.Temperature),
+			first.Data.DevLoc, first.Data.SysDescription, c.DnsName, first.Data.HwVersion, first.Data.FwVersion,
+			first.Data.MacAddress, first.Data.SysTime, first.Data.RunTime, first.Data.SeNumber)
+	}
+	for _, p := range c.Ports {
+		unit, _, port, ok := parsePort(p.Port)
+		if !ok || unit != strconv.Itoa(first.ID) {
+			continue
+		}
+		num, _ := strconv.ParseFloat(port, 64)
+		var vlanName []string
+		var vlanId []float64
+		speed := c.LinkSpeed(p)
+		if speed == model.UnknownSpeed {
+			speed = 0
+		}
+		ch <- prometheus.MustNewConstMetric(legacy.speed, prometheus.GaugeValue, speed/1e6,
+			port, c.DnsName)
+		if !snap.failed["portstats"] {
+			ch <- prometheus.MustNewConstMetric(legacy.rxPackets, prometheus.GaugeValue, float64(p.PktsRx),
+				port, c.DnsName)
+			ch <- prometheus.MustNewConstMetric(legacy.txPackets, prometheus.GaugeValue, float64(p.PktsTx),
+				port, c.DnsName)
+			ch <- prometheus.MustNewConstMetric(legacy.rxBadPackets, prometheus.GaugeValue, float64(p.ErrorsRx),
+				port, c.DnsName)
+			ch <- prometheus.MustNewConstMetric(legacy.txBadPackets, prometheus.GaugeValue, float64(p.ErrorsTx),
+				port, c.DnsName)
+			ch <- prometheus.MustNewConstMetric(legacy.broadcastRxPackets, prometheus.GaugeValue, float64(p.BroadcastRx),
+				port, c.DnsName)
+			ch <- prometheus.MustNewConstMetric(legacy.broadcastTxPackets, prometheus.GaugeValue, float64(p.BroadcastTx),
+				port, c.DnsName)
+			ch <- prometheus.MustNewConstMetric(legacy.unicastRxPackets, prometheus.GaugeValue, float64(p.UnicastRx),
+				port, c.DnsName)
+			ch <- prometheus.MustNewConstMetric(legacy.unicastTxPackets, prometheus.GaugeValue, float64(p.UnicastTx),
+				port, c.DnsName)
+			ch <- prometheus.MustNewConstMetric(legacy.multicastRxPackets, prometheus.GaugeValue, float64(p.MulticastRx),
+				port, c.DnsName)
+			ch <- prometheus.MustNewConstMetric(legacy.multicastTxPackets, prometheus.GaugeValue, float64(p.MulticastTx),
+				port, c.DnsName)
+		}
+		// Vlans
+		if !snap.failed["portvlans"] {
+			for _, vl := range p.Vlans {
+				vlanName = append(vlanName, vl.Name)
+				vlanId = append(vlanId, vl.VlanID)
+			}
+			ch <- prometheus.MustNewConstMetric(legacy.vlans, prometheus.GaugeValue, num, strings.Join(vlanName, ","),
+				strings.Trim(strings.Replace(fmt.Sprint(vlanId), " ", ",", -1), "[]"), c.DnsName, port)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/burningsunrise/tplink-exporter/parser"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// NewProbeHandler returns the handler for /probe?target=<host>&module=<name>,
+// every request gets its own registry so only the requested switch is scraped
+// on engine. Modules and device labels are looked up in the configuration
+// returned by config. Targets that are not configured need a module, unless
+// allowDefault lets them fall back to the top level credentials
+func NewProbeHandler(engine *Engine, config func() *parser.YamlConfig, allowDefault, legacy bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		probeHandler(w, r, engine, config(), allowDefault, legacy)
+	}
+}
+
+// scrapeTimeoutOffset is subtracted from the scrape timeout sent by
+// Prometheus, leaving time to answer with what was gathered before it gives up
+const scrapeTimeoutOffset = 500 * time.Millisecond
+
+// defaultScrapeTimeout is used when a probe does not come with the header,
+// e.g. when it is requested by hand, it is the default of Prometheus
+const defaultScrapeTimeout = 10 * time.Second
+
+// scrapeTimeout returns how long a probe may take according to the
+// X-Prometheus-Scrape-Timeout-Seconds header, defaultScrapeTimeout when the
+// header is missing
+func scrapeTimeout(r *http.Request) (time.Duration, error) {
+	timeout := defaultScrapeTimeout
+	if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+		seconds, err := strconv.ParseFloat(header, 64)
+		if err != nil || seconds <= 0 {
+			return 0, fmt.Errorf("invalid X-Prometheus-Scrape-Timeout-Seconds %q", header)
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout > scrapeTimeoutOffset {
+		timeout -= scrapeTimeoutOffset
+	}
+	return timeout, nil
+}
+
+func probeHandler(w http.ResponseWriter, r *http.Request, engine *Engine, y *parser.YamlConfig,
+	allowDefault, legacy bool) {
+	params := r.URL.Query()
+	target := params.Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	module := params.Get("module")
+
+	// configured devices are probed with their own module and labels unless
+	// the module parameter overrides it
+	device, configured := y.Device(target)
+	if module == "" && !configured && !allowDefault {
+		// the caller picks the target, do not send it the top level
+		// credentials unless asked to
+		http.Error(w, fmt.Sprintf("target %q is not configured, the module parameter is required", target),
+			http.StatusBadRequest)
+		return
+	}
+	var m parser.Module
+	var err error
+	if module == "" && configured {
+		m, err = y.DeviceModule(device)
+	} else {
+		m, err = y.Module(module)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unknown module %q", module), http.StatusBadRequest)
+		log.WithFields(log.Fields{
+			"probe":  target,
+			"module": module,
+		}).Error(err)
+		return
+	}
+
+	timeout, err := scrapeTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewTplinkProbeCollector(ctx, engine, target, m, device.Labels, legacy))
+
+	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	h.ServeHTTP(w, r)
+}
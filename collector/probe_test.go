@@ -0,0 +1,105 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/burningsunrise/tplink-exporter/fakeswitch"
+	"github.com/burningsunrise/tplink-exporter/parser"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScrapeTimeout(t *testing.T) {
+	tests := []struct {
+		header  string
+		timeout time.Duration
+		invalid bool
+	}{
+		{"", 9500 * time.Millisecond, false},
+		{"10", 9500 * time.Millisecond, false},
+		{"2.5", 2 * time.Second, false},
+		{"0.2", 200 * time.Millisecond, false},
+		{"0", 0, true},
+		{"soon", 0, true},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/probe?target=switch", nil)
+		if test.header != "" {
+			r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", test.header)
+		}
+		timeout, err := scrapeTimeout(r)
+		if (err != nil) != test.invalid {
+			t.Errorf("%q: got error %v", test.header, err)
+		}
+		if timeout != test.timeout {
+			t.Errorf("%q: got %v, want %v", test.header, timeout, test.timeout)
+		}
+	}
+}
+
+func TestProbeCollectorDeadline(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+	fake.Delay(100 * time.Millisecond)
+
+	// login and the first stages fit, the six ports of portstats do not
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	collector := NewTplinkProbeCollector(ctx, newTestEngine(t), fake.Host(), credentials, nil, false)
+	if _, err := testutil.CollectAndLint(collector); err != nil {
+		t.Fatal(err)
+	}
+
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("probe took %v, want it aborted at the deadline", took)
+	}
+	if requests := fake.Requests("trafficMonitorCfgDetailModel"); requests >= 6 {
+		t.Errorf("got %d port statistics requests, want the remaining ports aborted", requests)
+	}
+	if requests := fake.Requests("cpuInfo"); requests != 0 {
+		t.Errorf("got %d cpu requests after the deadline, want 0", requests)
+	}
+}
+
+func TestProbeHandlerDefaultModule(t *testing.T) {
+	configured := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer configured.Close()
+	other := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer other.Close()
+
+	y := &parser.YamlConfig{
+		User:     credentials.User,
+		Password: credentials.Password,
+		Devices:  []parser.Device{{Host: configured.Host()}},
+		Modules:  map[string]parser.Module{"lab": credentials},
+	}
+	config := func() *parser.YamlConfig { return y }
+	engine := newTestEngine(t)
+
+	tests := []struct {
+		query        string
+		allowDefault bool
+		status       int
+	}{
+		{"target=" + configured.Host(), false, http.StatusOK},
+		{"target=" + other.Host() + "&module=lab", false, http.StatusOK},
+		{"target=" + other.Host(), false, http.StatusBadRequest},
+		{"target=" + other.Host(), true, http.StatusOK},
+	}
+	for _, test := range tests {
+		logins := other.Logins()
+		w := httptest.NewRecorder()
+		NewProbeHandler(engine, config, test.allowDefault, false)(w, httptest.NewRequest("GET", "/probe?"+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.query, w.Code, test.status)
+		}
+		if test.status != http.StatusOK && other.Logins() != logins {
+			t.Errorf("%s: credentials were sent to the target", test.query)
+		}
+	}
+}
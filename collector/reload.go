@@ -0,0 +1,118 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/burningsunrise/tplink-exporter/parser"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reloader reloads the configuration on request and exports whether the last
+// reload succeeded. Reloads are serialized, onReload is called with every
+// configuration that was loaded successfully
+type Reloader struct {
+	store    *parser.ConfigStore
+	onReload func(y *parser.YamlConfig)
+	mu       sync.Mutex
+
+	successful prometheus.Gauge
+	timestamp  prometheus.Gauge
+}
+
+// NewReloader returns a reloader of store, the configuration loaded at
+// startup counts as the first successful reload
+func NewReloader(store *parser.ConfigStore, onReload func(y *parser.YamlConfig)) *Reloader {
+	r := &Reloader{
+		store:    store,
+		onReload: onReload,
+		successful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tplink_config_last_reload_successful",
+			Help: "Whether the last configuration reload succeeded",
+		}),
+		timestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tplink_config_last_reload_success_timestamp_seconds",
+			Help: "Unix time of the last successful configuration reload",
+		}),
+	}
+	r.successful.Set(1)
+	r.timestamp.SetToCurrentTime()
+	return r
+}
+
+// Reload reads the configuration file again, when it is invalid the error is
+// returned and the previous configuration stays in use
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.store.Reload(); err != nil {
+		r.successful.Set(0)
+		log.WithFields(log.Fields{
+			"reload": "failed",
+		}).Error(err)
+		return err
+	}
+	r.successful.Set(1)
+	r.timestamp.SetToCurrentTime()
+	log.WithFields(log.Fields{
+		"reload": "successful",
+	}).Info("configuration reloaded")
+	r.onReload(r.store.Get())
+	return nil
+}
+
+// ServeHTTP reloads the configuration on POST /-/reload
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.Reload(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "config reloaded")
+}
+
+// Watch reloads the configuration whenever the modification time or size of
+// the file changes, it is checked every interval until ctx is done
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	last, _ := os.Stat(r.store.Path())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(r.store.Path())
+		if err != nil {
+			// being replaced, try again on the next tick
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		r.Reload()
+	}
+}
+
+func (r *Reloader) Describe(ch chan<- *prometheus.Desc) {
+	r.successful.Describe(ch)
+	r.timestamp.Describe(ch)
+}
+
+func (r *Reloader) Collect(ch chan<- prometheus.Metric) {
+	r.successful.Collect(ch)
+	r.timestamp.Collect(ch)
+}
@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/burningsunrise/tplink-exporter/parser"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const reloadConfig = "user: admin\npassword: secret\ndevices:\n  - 10.1.1.2\n"
+
+// newTestReloader returns a reloader of a config file in a temporary
+// directory and how often it reloaded successfully
+func newTestReloader(t *testing.T) (*Reloader, string, *int32) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(reloadConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := parser.NewConfigStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reloads int32
+	reloader := NewReloader(store, func(*parser.YamlConfig) { atomic.AddInt32(&reloads, 1) })
+	return reloader, path, &reloads
+}
+
+func TestReloadHandler(t *testing.T) {
+	reloader, path, reloads := newTestReloader(t)
+
+	reload := func(method string) int {
+		w := httptest.NewRecorder()
+		reloader.ServeHTTP(w, httptest.NewRequest(method, "/-/reload", nil))
+		return w.Code
+	}
+	if code := reload("GET"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got status %d", code)
+	}
+
+	if err := os.WriteFile(path, []byte(reloadConfig+"  - 10.1.1.3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if code := reload("POST"); code != http.StatusOK {
+		t.Errorf("POST: got status %d", code)
+	}
+	if *reloads != 1 || len(reloader.store.Get().Devices) != 2 {
+		t.Errorf("reload not applied")
+	}
+
+	// a half edited file keeps the previous configuration
+	if err := os.WriteFile(path, []byte("devices:\n  - host: 10.1.1.2\n    module: lab\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if code := reload("POST"); code != http.StatusInternalServerError {
+		t.Errorf("POST of a broken file: got status %d", code)
+	}
+	if *reloads != 1 || len(reloader.store.Get().Devices) != 2 {
+		t.Errorf("failed reload replaced the configuration")
+	}
+	expected := `
+# HELP tplink_config_last_reload_successful Whether the last configuration reload succeeded
+# TYPE tplink_config_last_reload_successful gauge
+tplink_config_last_reload_successful 0
+`
+	if err := testutil.CollectAndCompare(reloader, strings.NewReader(expected), "tplink_config_last_reload_successful"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReloadWatch(t *testing.T) {
+	reloader, path, reloads := newTestReloader(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Watch(ctx, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(reloads) != 0 {
+		t.Fatal("reloaded an unchanged file")
+	}
+	if err := os.WriteFile(path, []byte(reloadConfig+"  - 10.1.1.3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(reloads) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(reloads); got != 1 {
+		t.Errorf("got %d reloads after changing the file, want 1", got)
+	}
+}
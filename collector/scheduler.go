@@ -0,0 +1,343 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/burningsunrise/tplink-exporter/model"
+	"github.com/burningsunrise/tplink-exporter/parser"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// staleIntervals is how many poll intervals a snapshot is served for after the
+// device stopped answering
+const staleIntervals = 3
+
+// idleWait is how long the scheduler sleeps when no device is configured
+const idleWait = time.Minute
+
+// busyWait is how often the scheduler looks for a free worker when devices
+// are due, polls it started itself wake it up earlier when they finish
+const busyWait = time.Second
+
+// snapshot is the last probe of a device that could be logged in to, failed
+// holds the stages whose data is missing from tplink
+type snapshot struct {
+	tplink    model.Tplink
+	timestamp time.Time
+	failed    map[string]bool
+}
+
+// scheduled is the polling state of a configured device
+type scheduled struct {
+	device  parser.Device
+	module  parser.Module
+	next    time.Time
+	running bool
+}
+
+// Scheduler polls every configured device in the background on its own
+// interval and caches the results, so scrapes never have to wait for a switch
+type Scheduler struct {
+	engine    *Engine
+	config    func() *parser.YamlConfig
+	now       func() time.Time
+	mu        sync.RWMutex
+	devices   map[string]*scheduled
+	snapshots map[string]snapshot
+	results   map[string]probeResult
+	running   sync.WaitGroup
+	wake      chan struct{}
+	stale     int32
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// NewScheduler returns a scheduler probing the devices returned by config on
+// engine
+func NewScheduler(engine *Engine, config func() *parser.YamlConfig) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		engine:    engine,
+		config:    config,
+		now:       time.Now,
+		devices:   map[string]*scheduled{},
+		snapshots: map[string]snapshot{},
+		results:   map[string]probeResult{},
+		wake:      make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// Run polls the devices until Stop is called. Whenever devices are due or
+// the configuration was reloaded the device list is updated from it, due
+// devices are handed to the engine by priority as long as it has free workers
+func (s *Scheduler) Run() {
+	defer close(s.done)
+	for {
+		wait := s.dispatch(s.now())
+		select {
+		case <-s.ctx.Done():
+			s.running.Wait()
+			return
+		case <-s.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Stop ends the polling loop, aborting the requests of running polls, and
+// waits for it to return
+func (s *Scheduler) Stop() {
+	s.cancel()
+	<-s.done
+}
+
+// dispatch starts the polls of the devices that are due and returns how long
+// to wait for the next one
+func (s *Scheduler) dispatch(now time.Time) time.Duration {
+	s.mu.RLock()
+	empty := len(s.devices) == 0
+	s.mu.RUnlock()
+	if empty || atomic.SwapInt32(&s.stale, 0) == 1 || len(s.due(now)) > 0 {
+		s.configure(now)
+	}
+
+	for _, host := range s.due(now) {
+		host := host
+		s.mu.Lock()
+		dev, ok := s.devices[host]
+		if !ok {
+			s.mu.Unlock()
+			continue
+		}
+		dev.running = true
+		module, interval := dev.module, dev.device.Interval
+		s.mu.Unlock()
+
+		// a poll is aborted when the next one is due, so a dead switch does
+		// not hold a worker for the timeouts of all its requests
+		ctx, cancel := context.WithTimeout(s.ctx, interval)
+		s.running.Add(1)
+		start := s.now()
+		// never wait for a worker here, /probe may take the one that was free
+		// and Run would stall every other device and reloads until it is done
+		err := s.engine.trySubmit(ctx, module, host, func(r probeResult) {
+			defer s.running.Done()
+			cancel()
+			s.finish(host, start, r)
+		})
+		if err != nil {
+			cancel()
+			s.running.Done()
+			s.mu.Lock()
+			dev.running = false
+			s.mu.Unlock()
+			if !errors.Is(err, errBusy) {
+				log.WithFields(log.Fields{
+					"poll": host,
+				}).Error(err)
+			}
+			// the rest stays due until a worker is free, finish or busyWait
+			// wakes us up
+			break
+		}
+	}
+	return s.nextWait(s.now())
+}
+
+// configure applies the current configuration, new devices are due right
+// away and devices that were removed are forgotten. Only Run calls it
+func (s *Scheduler) configure(now time.Time) {
+	y := s.config()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	configured := map[string]bool{}
+	for _, device := range y.Devices {
+		module, err := y.DeviceModule(device)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"device": device.Host,
+			}).Error(err)
+			continue
+		}
+		configured[device.Host] = true
+		if dev, ok := s.devices[device.Host]; ok {
+			dev.device = device
+			dev.module = module
+			continue
+		}
+		s.devices[device.Host] = &scheduled{device: device, module: module, next: now}
+	}
+	for host := range s.devices {
+		if !configured[host] {
+			delete(s.devices, host)
+			delete(s.snapshots, host)
+			delete(s.results, host)
+		}
+	}
+}
+
+// Reconfigure makes Run apply a new configuration right away instead of the
+// next time a device is due, added devices are polled immediately
+func (s *Scheduler) Reconfigure() {
+	atomic.StoreInt32(&s.stale, 1)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due returns the idle devices whose poll is due, highest priority first and
+// longest overdue first within a priority
+func (s *Scheduler) due(now time.Time) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var due []*scheduled
+	for _, dev := range s.devices {
+		if !dev.running && !dev.next.After(now) {
+			due = append(due, dev)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].device.Priority != due[j].device.Priority {
+			return due[i].device.Priority > due[j].device.Priority
+		}
+		return due[i].next.Before(due[j].next)
+	})
+	hosts := make([]string, len(due))
+	for i, dev := range due {
+		hosts[i] = dev.device.Host
+	}
+	return hosts
+}
+
+// nextWait returns how long until the next idle device is due
+func (s *Scheduler) nextWait(now time.Time) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	wait := idleWait
+	for _, dev := range s.devices {
+		if !dev.running && dev.next.Sub(now) < wait {
+			wait = dev.next.Sub(now)
+		}
+	}
+	if wait <= 0 {
+		// due but no worker is free, do not spin until one is
+		return busyWait
+	}
+	return wait
+}
+
+// finish stores the result of a poll of host that started at start and
+// schedules its next poll
+func (s *Scheduler) finish(host string, start time.Time, r probeResult) {
+	defer func() {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}()
+	if s.ctx.Err() != nil {
+		// stopped while polling, keep the results of the previous poll
+		return
+	}
+
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dev, ok := s.devices[host]
+	if !ok {
+		// removed from the configuration while it was polled
+		return
+	}
+	dev.running = false
+	dev.next = start.Add(dev.device.Interval)
+	if took := now.Sub(start); took > dev.device.Interval {
+		log.WithFields(log.Fields{
+			"host":     host,
+			"interval": dev.device.Interval,
+			"took":     took,
+		}).Warn("polling took longer than the configured interval, the rest of the poll was aborted")
+	}
+
+	s.results[host] = r
+	if r.up && r.answered() {
+		// a poll that never reached the switch keeps the old snapshot, so it
+		// turns stale when the switch stays away
+		s.snapshots[host] = snapshot{tplink: r.tplink, timestamp: now, failed: r.failed()}
+	}
+}
+
+// Labels returns the labels configured for host
+func (s *Scheduler) Labels(host string) map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if dev, ok := s.devices[host]; ok {
+		return dev.device.Labels
+	}
+	return nil
+}
+
+// LabelNames returns the names of the labels of every device, sorted
+func (s *Scheduler) LabelNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seen := map[string]bool{}
+	for _, dev := range s.devices {
+		for name := range dev.device.Labels {
+			seen[name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Snapshots returns the cached snapshots that are not stale sorted by host
+func (s *Scheduler) Snapshots() []snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshots := make([]snapshot, 0, len(s.snapshots))
+	for host, snap := range s.snapshots {
+		dev, ok := s.devices[host]
+		if !ok || s.now().Sub(snap.timestamp) > staleIntervals*dev.device.Interval {
+			continue
+		}
+		snapshots = append(snapshots, snap)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].tplink.DnsName < snapshots[j].tplink.DnsName
+	})
+	return snapshots
+}
+
+// Results returns the outcome of the last poll of every device sorted by host
+func (s *Scheduler) Results() []probeResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := make([]probeResult, 0, len(s.results))
+	for _, r := range s.results {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].tplink.DnsName < results[j].tplink.DnsName
+	})
+	return results
+}
@@ -0,0 +1,330 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/burningsunrise/tplink-exporter/fakeswitch"
+	"github.com/burningsunrise/tplink-exporter/parser"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestScheduler returns a scheduler polling devices on a pool of size
+// workers
+func newTestScheduler(t *testing.T, size int, devices []parser.Device) *Scheduler {
+	t.Helper()
+	engine, err := NewEngine(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(engine.pool.Release)
+
+	y := &parser.YamlConfig{User: credentials.User, Password: credentials.Password, Devices: devices}
+	return NewScheduler(engine, func() *parser.YamlConfig { return y })
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	hosts := map[string]int{}
+	var devices []parser.Device
+	for _, priority := range []int{0, 10, 5} {
+		fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+		defer fake.Close()
+		fake.Delay(10 * time.Millisecond)
+		hosts[fake.Host()] = priority
+		devices = append(devices, parser.Device{Host: fake.Host(), Interval: time.Hour, Priority: priority})
+	}
+
+	scheduler := newTestScheduler(t, 1, devices)
+	go scheduler.Run()
+	defer scheduler.Stop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(scheduler.Snapshots()) < len(devices) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	snapshots := scheduler.Snapshots()
+	if len(snapshots) != len(devices) {
+		t.Fatalf("got %d snapshots, want %d", len(snapshots), len(devices))
+	}
+	for _, a := range snapshots {
+		for _, b := range snapshots {
+			if hosts[a.tplink.DnsName] > hosts[b.tplink.DnsName] && a.timestamp.After(b.timestamp) {
+				t.Errorf("priority %d was polled after priority %d", hosts[a.tplink.DnsName], hosts[b.tplink.DnsName])
+			}
+		}
+	}
+}
+
+func TestSchedulerDeviceInterval(t *testing.T) {
+	fast := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fast.Close()
+	slow := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer slow.Close()
+
+	scheduler := newTestScheduler(t, 2, []parser.Device{
+		{Host: fast.Host(), Interval: time.Minute},
+		{Host: slow.Host(), Interval: time.Hour},
+	})
+	// drive the scheduler with a clock of its own instead of Run, every
+	// dispatch waits for the polls it started
+	clock := time.Now()
+	scheduler.now = func() time.Time { return clock }
+	for i := 0; i < 5; i++ {
+		scheduler.dispatch(clock)
+		scheduler.running.Wait()
+		clock = clock.Add(time.Minute)
+	}
+
+	if polls := fast.Requests("cpuInfo"); polls != 5 {
+		t.Errorf("fast device was polled %d times, want 5", polls)
+	}
+	if polls := slow.Requests("cpuInfo"); polls != 1 {
+		t.Errorf("slow device was polled %d times, want 1", polls)
+	}
+	if snapshots := scheduler.Snapshots(); len(snapshots) != 2 {
+		t.Errorf("got %d snapshots, want the slow device to stay fresh", len(snapshots))
+	}
+}
+
+// TestSchedulerSwitchGone powers the switch off between two polls, the cached
+// session may not hide that it is gone
+func TestSchedulerSwitchGone(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+
+	scheduler := newTestScheduler(t, 1, []parser.Device{{Host: fake.Host(), Interval: time.Minute}})
+	clock := time.Now()
+	scheduler.now = func() time.Time { return clock }
+	scheduler.dispatch(clock)
+	scheduler.running.Wait()
+	first := scheduler.Snapshots()
+	if len(first) != 1 {
+		t.Fatalf("got %d snapshots after the first poll, want 1", len(first))
+	}
+
+	fake.Close()
+	for i := 1; i <= staleIntervals+1; i++ {
+		clock = clock.Add(time.Minute)
+		scheduler.dispatch(clock)
+		scheduler.running.Wait()
+
+		if results := scheduler.Results(); len(results) != 1 || results[0].up {
+			t.Fatalf("poll %d: got %+v, want the switch down", i, results)
+		}
+		snapshots := scheduler.Snapshots()
+		if i <= staleIntervals && (len(snapshots) != 1 || !snapshots[0].timestamp.Equal(first[0].timestamp)) {
+			t.Errorf("poll %d: got snapshots %+v, want the first one kept", i, snapshots)
+		}
+		if i > staleIntervals && len(snapshots) != 0 {
+			t.Errorf("poll %d: got %d snapshots, want the first one stale", i, len(snapshots))
+		}
+	}
+}
+
+// TestSchedulerWorkerTakenByProbe lets a probe hold the only worker, dispatch
+// has to return right away and poll the device once the worker is free
+func TestSchedulerWorkerTakenByProbe(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+
+	scheduler := newTestScheduler(t, 1, []parser.Device{{Host: fake.Host(), Interval: time.Minute}})
+	// the probe holds the worker until it is cancelled
+	fake.Delay(time.Minute)
+	busy, cancel := context.WithCancel(context.Background())
+	released := make(chan struct{})
+	if err := scheduler.engine.submit(busy, credentials, fake.Host(), func(probeResult) { close(released) }); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := time.Now()
+	scheduler.now = func() time.Time { return clock }
+	start := time.Now()
+	if wait := scheduler.dispatch(clock); wait != busyWait {
+		t.Errorf("got wait %v, want busyWait while the device is due", wait)
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("dispatch took %v, want it not to wait for the worker", took)
+	}
+
+	cancel()
+	<-released
+	fake.Delay(0)
+	scheduler.dispatch(clock)
+	scheduler.running.Wait()
+	if results := scheduler.Results(); len(results) != 1 || !results[0].up {
+		t.Errorf("got %+v, want the device polled once the worker is free", results)
+	}
+}
+
+func TestSchedulerDeviceModulesAndLabels(t *testing.T) {
+	office := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer office.Close()
+	lab := fakeswitch.NewFromDir(fixtures, "lab", "other secret")
+	defer lab.Close()
+
+	engine, err := NewEngine(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(engine.pool.Release)
+	y := &parser.YamlConfig{
+		User:     credentials.User,
+		Password: credentials.Password,
+		Devices: []parser.Device{
+			{Host: office.Host(), Interval: time.Hour, Labels: map[string]string{"site": "office"}},
+			{Host: lab.Host(), Interval: time.Hour, Module: "lab", Labels: map[string]string{"rack": "r1"}},
+		},
+		Modules: map[string]parser.Module{"lab": {User: "lab", Password: "other secret"}},
+	}
+	scheduler := NewScheduler(engine, func() *parser.YamlConfig { return y })
+	go scheduler.Run()
+	defer scheduler.Stop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(scheduler.Snapshots()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expected := fmt.Sprintf(`
+# HELP tplink_up Whether the switch could be logged in to and answered on the last poll
+# TYPE tplink_up gauge
+tplink_up{host="%s",rack="",site="office"} 1
+tplink_up{host="%s",rack="r1",site=""} 1
+`, office.Host(), lab.Host())
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(NewTplinkCollector(scheduler, false))
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "tplink_up"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchedulerReconfigure(t *testing.T) {
+	first := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer first.Close()
+	added := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer added.Close()
+
+	engine, err := NewEngine(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(engine.pool.Release)
+	var config atomic.Value
+	config.Store(&parser.YamlConfig{User: credentials.User, Password: credentials.Password,
+		Devices: []parser.Device{{Host: first.Host(), Interval: time.Hour}}})
+	scheduler := NewScheduler(engine, func() *parser.YamlConfig { return config.Load().(*parser.YamlConfig) })
+	go scheduler.Run()
+	defer scheduler.Stop()
+
+	waitForSnapshot := func(host string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if snapshots := scheduler.Snapshots(); len(snapshots) == 1 && snapshots[0].tplink.DnsName == host {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForSnapshot(first.Host())
+
+	// the devices are only due in an hour, the added one is polled right away
+	// and the removed one is forgotten
+	config.Store(&parser.YamlConfig{User: credentials.User, Password: credentials.Password,
+		Devices: []parser.Device{{Host: added.Host(), Interval: time.Hour}}})
+	scheduler.Reconfigure()
+	waitForSnapshot(added.Host())
+	snapshots := scheduler.Snapshots()
+	if len(snapshots) != 1 || snapshots[0].tplink.DnsName != added.Host() {
+		t.Fatalf("got %d snapshots, want only the one of %s", len(snapshots), added.Host())
+	}
+}
+
+// TestSchedulerPollDeadline polls a switch that answers slower than the
+// interval, the poll is aborted when the next one is due
+func TestSchedulerPollDeadline(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+	fake.Delay(5 * time.Second)
+
+	scheduler := newTestScheduler(t, 1, []parser.Device{{Host: fake.Host(), Interval: 100 * time.Millisecond}})
+	go scheduler.Run()
+	defer scheduler.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(scheduler.Results()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	results := scheduler.Results()
+	if len(results) != 1 || len(results[0].failed()) == 0 {
+		t.Fatalf("got %d results, want one aborted poll before the switch answered", len(results))
+	}
+}
+
+// TestSchedulerReloadWhileDispatching reloads device lists that remove the
+// devices being dispatched and polled, run it with -race. Every reload adds
+// devices that are due right away, a short interval would only pile up
+// aborted TLS handshakes
+func TestSchedulerReloadWhileDispatching(t *testing.T) {
+	var devices [2][]parser.Device
+	for i := 0; i < 16; i++ {
+		fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+		defer fake.Close()
+		devices[i%2] = append(devices[i%2], parser.Device{Host: fake.Host(), Interval: time.Second})
+	}
+
+	engine, err := NewEngine(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(engine.pool.Release)
+	var config atomic.Value
+	config.Store(&parser.YamlConfig{User: credentials.User, Password: credentials.Password, Devices: devices[0]})
+	scheduler := NewScheduler(engine, func() *parser.YamlConfig { return config.Load().(*parser.YamlConfig) })
+	go scheduler.Run()
+
+	var last []parser.Device
+	for i, deadline := 0, time.Now().Add(300*time.Millisecond); time.Now().Before(deadline); i++ {
+		last = devices[i%2]
+		config.Store(&parser.YamlConfig{User: credentials.User, Password: credentials.Password, Devices: last})
+		scheduler.Reconfigure()
+	}
+	want := map[string]bool{}
+	for _, device := range last {
+		want[device.Host] = true
+	}
+	// Run applies the last reload on its own time
+	applied := func() bool {
+		scheduler.mu.RLock()
+		defer scheduler.mu.RUnlock()
+		for host := range scheduler.devices {
+			if !want[host] {
+				return false
+			}
+		}
+		return len(scheduler.devices) == len(want)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !applied() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	scheduler.Stop()
+
+	if !applied() {
+		t.Errorf("got %d devices, want only the %d of the last device list", len(scheduler.devices), len(want))
+	}
+	for host := range scheduler.snapshots {
+		if !want[host] {
+			t.Errorf("snapshot of removed device %s", host)
+		}
+	}
+	for host := range scheduler.results {
+		if !want[host] {
+			t.Errorf("result of removed device %s", host)
+		}
+	}
+}
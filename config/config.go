@@ -8,13 +8,16 @@ import (
 	"github.com/joho/godotenv"
 )
 
+// EnvFile is the path of the env file Config loads before reading a variable
+var EnvFile = ".env"
+
 // Config func to get env value
 func Config(key string) string {
 	// load .env file
-	if _, err := os.Stat(".env"); errors.Is(err, os.ErrNotExist) {
+	if _, err := os.Stat(EnvFile); errors.Is(err, os.ErrNotExist) {
 		return os.Getenv(key)
 	}
-	err := godotenv.Load(".env")
+	err := godotenv.Load(EnvFile)
 	if err != nil {
 		log.Println("Error loading .env file, maybe docker trying to get environment variables")
 	}
@@ -0,0 +1,231 @@
+// Package fakeswitch is an in-process fake of the TP-Link web interface that
+// answers with canned responses, so the exporter can be tested without
+// hardware.
+//
+// The synthetic-* fixture sets in fixtures were written by hand after the
+// response format the exporter parses and were not captured from real
+// switches. Captures made with -record are added next to them, named after
+// the model and firmware.
+//
+// A fixture set is a directory of <endpoint>.json files. Requests that select
+// a unit or a port are first looked up as <endpoint>_<unit>.json, e.g.
+// port_unit1.json, or <endpoint>_<port>.json with the slashes of the port
+// replaced by dashes, e.g. trafficMonitorCfgDetailModel_1-0-1.json, before
+// falling back to <endpoint>.json. Endpoints without a fixture answer with
+// success set to false, the way the firmware answers for a missing stack unit.
+package fakeswitch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Switch is a fake switch serving a fixture set over HTTPS
+type Switch struct {
+	*httptest.Server
+
+	fixtures fs.FS
+	user     string
+	password string
+
+	mu       sync.Mutex
+	tid      string
+	sessions int
+	logins   int
+	logouts  int
+	requests map[string]int
+	replaced map[string][]byte
+	delay    time.Duration
+	inFlight int
+	peak     int
+}
+
+// New starts a fake switch serving fixtures that accepts the given credentials
+func New(fixtures fs.FS, user, password string) *Switch {
+	s := &Switch{
+		fixtures: fixtures,
+		user:     user,
+		password: password,
+		requests: map[string]int{},
+		replaced: map[string][]byte{},
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// NewFromDir starts a fake switch serving the fixture set in dir
+func NewFromDir(dir, user, password string) *Switch {
+	return New(os.DirFS(dir), user, password)
+}
+
+// Host returns the address of the switch the way it is written in config.yaml
+func (s *Switch) Host() string {
+	return strings.TrimPrefix(s.URL, "https://")
+}
+
+// Expire ends the current web session, the next request with its _tid_ is
+// answered with timeout set
+func (s *Switch) Expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tid = ""
+}
+
+// Replace answers with response instead of the fixture file name from now on,
+// to test how the exporter copes with broken responses
+func (s *Switch) Replace(name, response string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replaced[name] = []byte(response)
+}
+
+// Delay makes every request after login take d, like a switch with a busy
+// management CPU
+func (s *Switch) Delay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = d
+}
+
+// PeakRequests returns the most requests after login the switch was answering
+// at the same time
+func (s *Switch) PeakRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak
+}
+
+// Logins returns how often someone logged in successfully
+func (s *Switch) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+// Logouts returns how often a session was logged out
+func (s *Switch) Logouts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logouts
+}
+
+// Requests returns how often endpoint was requested
+func (s *Switch) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+func (s *Switch) handle(w http.ResponseWriter, r *http.Request) {
+	endpoint := strings.TrimSuffix(path.Base(r.URL.Path), ".json")
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	s.requests[endpoint]++
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch endpoint {
+	case "login":
+		s.login(w, body)
+		return
+	}
+
+	s.mu.Lock()
+	delay := s.delay
+	s.inFlight++
+	if s.inFlight > s.peak {
+		s.peak = s.inFlight
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+	select {
+	case <-r.Context().Done():
+		return
+	case <-time.After(delay):
+	}
+
+	s.mu.Lock()
+	valid := s.tid != "" && r.URL.Query().Get("_tid_") == s.tid
+	if valid && endpoint == "logout" {
+		s.tid = ""
+		s.logouts++
+	}
+	s.mu.Unlock()
+
+	if !valid {
+		fmt.Fprint(w, `{"success":false,"errorcode":0,"timeout":true}`)
+		return
+	}
+	if endpoint == "logout" {
+		fmt.Fprint(w, `{"success":true,"errorcode":0,"timeout":false}`)
+		return
+	}
+
+	fixture, err := s.fixture(endpoint, body)
+	if err != nil {
+		fmt.Fprint(w, `{"success":false,"errorcode":-1,"timeout":false}`)
+		return
+	}
+	w.Write(fixture)
+}
+
+func (s *Switch) login(w http.ResponseWriter, body []byte) {
+	var login struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(body, &login); err != nil || login.Username != s.user || login.Password != s.password {
+		fmt.Fprint(w, `{"success":false,"errorcode":-20002,"timeout":false}`)
+		return
+	}
+
+	s.mu.Lock()
+	s.sessions++
+	s.logins++
+	s.tid = fmt.Sprintf("fake%08x", s.sessions)
+	tid := s.tid
+	s.mu.Unlock()
+
+	fmt.Fprintf(w, `{"data":{"_tid_":"%s","usrLvl":1,"pwdNeedChange":0},"success":true,"errorcode":0,"timeout":false}`, tid)
+}
+
+// fixture finds the response for a request to endpoint with body
+func (s *Switch) fixture(endpoint string, body []byte) ([]byte, error) {
+	var payload map[string]interface{}
+	json.Unmarshal(body, &payload)
+
+	var names []string
+	for _, key := range []string{"port", "tab", "unit"} {
+		if value, ok := payload[key].(string); ok {
+			names = append(names, endpoint+"_"+strings.ReplaceAll(value, "/", "-")+".json")
+		}
+	}
+	names = append(names, endpoint+".json")
+
+	for _, name := range names {
+		s.mu.Lock()
+		response, ok := s.replaced[name]
+		s.mu.Unlock()
+		if ok {
+			return response, nil
+		}
+		if data, err := fs.ReadFile(s.fixtures, name); err == nil {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("no fixture for %s", endpoint)
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/burningsunrise/tplink-exporter/collector"
+	"github.com/burningsunrise/tplink-exporter/config"
 	"github.com/burningsunrise/tplink-exporter/formatter"
+	"github.com/burningsunrise/tplink-exporter/model"
+	"github.com/burningsunrise/tplink-exporter/parser"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -23,11 +33,135 @@ func init() {
 	log.SetFormatter(format)
 }
 
+// envOr returns the value of the env variable key, or def when it is not set
+func envOr(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return def
+}
+
+// envDuration returns the duration in the env variable key, or def when it is
+// not set
+func envDuration(key string, def time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s: %v", key, err)
+	}
+	return d
+}
+
 func main() {
-	tplinkCollector := collector.NewTplinkCollector()
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(checkConfig(os.Args[2:]))
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s check-config [-config file]\n",
+			os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	configFile := flag.String("config", envOr("TPLINK_CONFIG", parser.DefaultConfigFile),
+		"path of the configuration file, env TPLINK_CONFIG")
+	envFile := flag.String("env-file", envOr("TPLINK_ENV_FILE", config.EnvFile),
+		"path of the env file holding USER and PASSWORD, env TPLINK_ENV_FILE")
+	listenAddress := flag.String("listen-address", envOr("TPLINK_LISTEN_ADDRESS", ":9797"),
+		"address to serve metrics on, env TPLINK_LISTEN_ADDRESS")
+	metricsPath := flag.String("metrics-path", envOr("TPLINK_METRICS_PATH", "/metrics"),
+		"path to serve the metrics of every device on, env TPLINK_METRICS_PATH")
+	logLevel := flag.String("log-level", envOr("TPLINK_LOG_LEVEL", "info"),
+		"one of trace, debug, info, warn, error, env TPLINK_LOG_LEVEL")
+	watchConfig := flag.Duration("watch-config", envDuration("TPLINK_WATCH_CONFIG", 0),
+		"reload the configuration file when it changes, checking it this often, 0 disables it, env TPLINK_WATCH_CONFIG")
+	probeDefaultModule := flag.Bool("probe-default-module", envOr("TPLINK_PROBE_DEFAULT_MODULE", "") == "true",
+		"let /probe log in to targets that are not configured with the top level credentials when no module is given, "+
+			"env TPLINK_PROBE_DEFAULT_MODULE")
+	legacyMetrics := flag.Bool("legacy-metrics", false,
+		"also export the metric names used before the tplink_ namespace")
+	record := flag.String("record", "",
+		"write every switch request and response to this directory, credentials and session ids are redacted")
+	replay := flag.String("replay", "",
+		"answer requests from the responses recorded in this directory instead of contacting the switches")
+	flag.Parse()
+
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetLevel(level)
+	config.EnvFile = *envFile
+
+	switch {
+	case *record != "" && *replay != "":
+		log.Fatal("-record and -replay cannot be used together")
+	case *record != "":
+		log.Info("recording switch responses to ", *record)
+		model.Record(*record)
+	case *replay != "":
+		log.Info("replaying switch responses from ", *replay)
+		model.Replay(*replay)
+	}
+
+	store, err := parser.NewConfigStore(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	y := store.Get()
+	engine, err := collector.NewEngine(y.PoolSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scheduler := collector.NewScheduler(engine, store.Get)
+	go scheduler.Run()
+
+	tplinkCollector := collector.NewTplinkCollector(scheduler, *legacyMetrics)
 	prometheus.MustRegister(tplinkCollector)
 
-	http.Handle("/metrics", promhttp.Handler())
-	log.Info("Beginning to serve on port :9797")
-	log.Fatal(http.ListenAndServe(":9797", nil))
+	reloader := collector.NewReloader(store, func(reloaded *parser.YamlConfig) {
+		if reloaded.PoolSize != y.PoolSize {
+			log.WithFields(log.Fields{
+				"pool_size": reloaded.PoolSize,
+			}).Warn("pool_size only changes on restart")
+		}
+		scheduler.Reconfigure()
+	})
+	prometheus.MustRegister(reloader)
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	if *watchConfig > 0 {
+		go reloader.Watch(watchCtx, *watchConfig)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloader.Reload()
+		}
+	}()
+
+	http.Handle(*metricsPath, promhttp.Handler())
+	http.Handle("/-/reload", reloader)
+	http.Handle("/probe", collector.NewProbeHandler(engine, store.Get, *probeDefaultModule, *legacyMetrics))
+	server := &http.Server{Addr: *listenAddress}
+	go func() {
+		log.Info("Beginning to serve on ", *listenAddress)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	log.Info("shutting down, logging out of all switches")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	scheduler.Stop()
+	engine.Close(ctx)
 }
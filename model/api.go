@@ -0,0 +1,382 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/burningsunrise/tplink-exporter/parser"
+)
+
+// Session is a logged in web session, every request after login carries it
+type Session struct {
+	Tid    string
+	UsrLvl int
+}
+
+// SwitchAPI is the web API of a single switch
+type SwitchAPI interface {
+	Host() string
+	Login(ctx context.Context, m parser.Module) (Session, error)
+	Logout(ctx context.Context, s Session) error
+	// SystemSummary returns the system summary of a unit, found is false
+	// when the stack has no such unit, a switch always has unit 1
+	SystemSummary(ctx context.Context, s Session, unit int) (system System, found bool, err error)
+	Ports(ctx context.Context, s Session, unit int) ([]Port, error)
+	TrafficStatistics(ctx context.Context, s Session, port string) (TrafficStatistics, error)
+	PortVlans(ctx context.Context, s Session, port string) ([]Vlan, error)
+	// PortVlanCfg returns the 802.1Q configuration of the ports of a unit
+	// keyed by port name
+	PortVlanCfg(ctx context.Context, s Session, unit int) (map[string]VlanCfg, error)
+	// MacVlanPorts returns the ports of a unit with MAC based VLANs enabled
+	MacVlanPorts(ctx context.Context, s Session, unit int) ([]string, error)
+	MacVlans(ctx context.Context, s Session) ([]MacVlan, error)
+	Memory(ctx context.Context, s Session, unit int) ([]float64, error)
+	Cpu(ctx context.Context, s Session, unit int) ([]float64, error)
+}
+
+// Client implements SwitchAPI over the HTTPS web interface of the switch,
+// at most maxRequests requests are sent to it at once
+type Client struct {
+	host     string
+	client   *http.Client
+	inFlight chan struct{}
+}
+
+func NewClient(host string, c *http.Client, maxRequests int) *Client {
+	if maxRequests < 1 {
+		maxRequests = 1
+	}
+	return &Client{host: host, client: c, inFlight: make(chan struct{}, maxRequests)}
+}
+
+func (c *Client) Host() string {
+	return c.host
+}
+
+// MaxRequests returns how many requests are sent to the switch at once
+func (c *Client) MaxRequests() int {
+	return cap(c.inFlight)
+}
+
+// loginRequest is the payload of login.json
+type loginRequest struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Operation string `json:"operation"`
+}
+
+// request is the payload of every endpoint but login.json, fields that are
+// not set are left out
+type request struct {
+	Operation string `json:"operation,omitempty"`
+	Special   string `json:"special,omitempty"`
+	Tab       string `json:"tab,omitempty"`
+	Unit      string `json:"unit,omitempty"`
+	Port      string `json:"port,omitempty"`
+}
+
+// unitName is how the firmware names a stack unit in tab and unit
+func unitName(unit int) string {
+	return fmt.Sprintf("unit%d", unit)
+}
+
+// loginResponse is the answer to login.json
+type loginResponse struct {
+	Data struct {
+		Tid    string `json:"_tid_"`
+		UsrLvl int    `json:"usrLvl"`
+	} `json:"data"`
+	Errorcode int `json:"errorcode"`
+}
+
+func (c *Client) Login(ctx context.Context, m parser.Module) (Session, error) {
+	var login loginResponse
+	url := fmt.Sprintf("https://%s/data/login.json", c.host)
+	payload := loginRequest{Username: m.User, Password: m.Password, Operation: "write"}
+
+	body, err := c.send(ctx, url, "login", payload)
+	if err != nil {
+		return Session{}, err
+	}
+	if err := c.decode("login", body, &login); err != nil {
+		return Session{}, err
+	}
+	if login.Data.Tid == "" {
+		return Session{}, c.fail("login", fmt.Errorf("login rejected with errorcode %d", login.Errorcode))
+	}
+	return Session{Tid: login.Data.Tid, UsrLvl: login.Data.UsrLvl}, nil
+}
+
+func (c *Client) Logout(ctx context.Context, s Session) error {
+	_, err := c.post(ctx, s, "logout", request{Operation: "write"})
+	return err
+}
+
+// systemResponse is the answer to systemSummaryConfig.json, memoryInfo.json
+// and cpuInfo.json
+type systemResponse struct {
+	Data System `json:"data"`
+}
+
+func (c *Client) SystemSummary(ctx context.Context, s Session, unit int) (System, bool, error) {
+	var system systemResponse
+	body, err := c.post(ctx, s, "systemSummaryConfig", request{Operation: "read", Tab: unitName(unit)})
+	if errors.Is(err, errRejected) && unit > 1 {
+		// the firmware rejects the tab of a unit that is not in the stack,
+		// every switch has unit 1 so rejecting it is an error
+		return System{}, false, nil
+	}
+	if err != nil {
+		return System{}, false, err
+	}
+	if err := c.decode("systemSummaryConfig", body, &system); err != nil {
+		return System{}, false, err
+	}
+	return system.Data, system.Data.MacAddress != "", nil
+}
+
+// portResponse is the answer to port.json
+type portResponse struct {
+	Data []Port `json:"data"`
+}
+
+func (c *Client) Ports(ctx context.Context, s Session, unit int) ([]Port, error) {
+	var ports portResponse
+	body, err := c.post(ctx, s, "port", request{Operation: "load", Special: "display", Tab: unitName(unit)})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.decode("port", body, &ports); err != nil {
+		return nil, err
+	}
+	return ports.Data, nil
+}
+
+// trafficStatisticsResponse is the answer to trafficMonitorCfgDetailModel.json
+type trafficStatisticsResponse struct {
+	Data trafficCounters `json:"data"`
+}
+
+// trafficCounters decodes TrafficStatistics sent as numbers or as strings with
+// thousands separators, depending on the firmware the switch sends either
+type trafficCounters TrafficStatistics
+
+func (t *trafficCounters) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for key, value := range fields {
+		var text string
+		if json.Unmarshal(value, &text) != nil {
+			continue
+		}
+		number := strings.ReplaceAll(text, ",", "")
+		if _, err := strconv.ParseFloat(number, 64); err != nil {
+			return fmt.Errorf("counter %s: %q is not a number", key, text)
+		}
+		fields[key] = json.RawMessage(number)
+	}
+	normalized, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(normalized, (*TrafficStatistics)(t))
+}
+
+func (c *Client) TrafficStatistics(ctx context.Context, s Session, port string) (TrafficStatistics, error) {
+	var stats trafficStatisticsResponse
+	body, err := c.post(ctx, s, "trafficMonitorCfgDetailModel", request{Operation: "read", Port: port})
+	if err != nil {
+		return TrafficStatistics{}, err
+	}
+	if err := c.decode("trafficMonitorCfgDetailModel", body, &stats); err != nil {
+		return TrafficStatistics{}, err
+	}
+	return TrafficStatistics(stats.Data), nil
+}
+
+// vlanPortDetailCfgResponse is the answer to vlanPortDetailCfg.json
+type vlanPortDetailCfgResponse struct {
+	Data []Vlan `json:"data"`
+}
+
+func (c *Client) PortVlans(ctx context.Context, s Session, port string) ([]Vlan, error) {
+	var vlans vlanPortDetailCfgResponse
+	body, err := c.post(ctx, s, "vlanPortDetailCfg", request{Operation: "load", Port: port})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.decode("vlanPortDetailCfg", body, &vlans); err != nil {
+		return nil, err
+	}
+	return vlans.Data, nil
+}
+
+// vlanPortCfgResponse is the answer to vlanPortCfg.json, key is the port
+type vlanPortCfgResponse struct {
+	Data []struct {
+		Key string `json:"key"`
+		VlanCfg
+	} `json:"data"`
+}
+
+func (c *Client) PortVlanCfg(ctx context.Context, s Session, unit int) (map[string]VlanCfg, error) {
+	var response vlanPortCfgResponse
+	body, err := c.post(ctx, s, "vlanPortCfg", request{Operation: "load", Tab: unitName(unit)})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.decode("vlanPortCfg", body, &response); err != nil {
+		return nil, err
+	}
+	cfgs := map[string]VlanCfg{}
+	for _, x := range response.Data {
+		cfgs[x.Key] = x.VlanCfg
+	}
+	return cfgs, nil
+}
+
+// vlanMacCfgModelResponse is the answer to vlanMacCfgModel.json, ports is a
+// comma separated list
+type vlanMacCfgModelResponse struct {
+	Data struct {
+		Ports string `json:"ports"`
+	} `json:"data"`
+}
+
+func (c *Client) MacVlanPorts(ctx context.Context, s Session, unit int) ([]string, error) {
+	var response vlanMacCfgModelResponse
+	body, err := c.post(ctx, s, "vlanMacCfgModel", request{Operation: "read", Tab: unitName(unit)})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.decode("vlanMacCfgModel", body, &response); err != nil {
+		return nil, err
+	}
+	if response.Data.Ports == "" {
+		return nil, nil
+	}
+	return strings.Split(response.Data.Ports, ","), nil
+}
+
+// vlanMacCfgResponse is the answer to vlanMacCfg.json
+type vlanMacCfgResponse struct {
+	Data []MacVlan `json:"data"`
+}
+
+func (c *Client) MacVlans(ctx context.Context, s Session) ([]MacVlan, error) {
+	var macvlans vlanMacCfgResponse
+	body, err := c.post(ctx, s, "vlanMacCfg", request{Operation: "load"})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.decode("vlanMacCfg", body, &macvlans); err != nil {
+		return nil, err
+	}
+	return macvlans.Data, nil
+}
+
+func (c *Client) Memory(ctx context.Context, s Session, unit int) ([]float64, error) {
+	system, err := c.unitInfo(ctx, s, "memoryInfo", unit)
+	return system.Memory, err
+}
+
+func (c *Client) Cpu(ctx context.Context, s Session, unit int) ([]float64, error) {
+	system, err := c.unitInfo(ctx, s, "cpuInfo", unit)
+	return system.Cpu, err
+}
+
+// unitInfo reads the memoryInfo or cpuInfo endpoint of a unit
+func (c *Client) unitInfo(ctx context.Context, s Session, endpoint string, unit int) (System, error) {
+	var info systemResponse
+	body, err := c.post(ctx, s, endpoint, request{Unit: unitName(unit)})
+	if err != nil {
+		return System{}, err
+	}
+	if err := c.decode(endpoint, body, &info); err != nil {
+		return System{}, err
+	}
+	return info.Data, nil
+}
+
+// errRejected is returned by post when the switch answers with success set to
+// false
+var errRejected = errors.New("request rejected")
+
+// post sends payload to the /data/<endpoint>.json endpoint of the switch with
+// the session and returns the response body, a response with timeout set is
+// returned as ErrSessionExpired
+func (c *Client) post(ctx context.Context, s Session, endpoint string, payload request) ([]byte, error) {
+	url := fmt.Sprintf("https://%s/data/%s.json?_tid_=%s&usrLvl=%d", c.host, endpoint, s.Tid, s.UsrLvl)
+	body, err := c.send(ctx, url, endpoint, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var e envelope
+	if err := c.decode(endpoint, body, &e); err != nil {
+		return nil, err
+	}
+	if e.Timeout {
+		return nil, c.fail(endpoint, ErrSessionExpired)
+	}
+	if !e.Success {
+		return nil, c.fail(endpoint, fmt.Errorf("%w with errorcode %d", errRejected, e.Errorcode))
+	}
+	return body, nil
+}
+
+// send posts payload as JSON to url and returns the body of a 200 response
+func (c *Client) send(ctx context.Context, url, endpoint string, payload interface{}) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, c.fail(endpoint, fmt.Errorf("encoding request: %w", err))
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, c.fail(endpoint, err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	select {
+	case c.inFlight <- struct{}{}:
+	case <-ctx.Done():
+		return nil, c.fail(endpoint, ctx.Err())
+	}
+	defer func() { <-c.inFlight }()
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, c.fail(endpoint, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, c.fail(endpoint, fmt.Errorf("unexpected HTTP status %s", res.Status))
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, c.fail(endpoint, fmt.Errorf("reading response: %w", err))
+	}
+	return body, nil
+}
+
+// decode unmarshals the response body of endpoint into v
+func (c *Client) decode(endpoint string, body []byte, v interface{}) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return c.fail(endpoint, fmt.Errorf("decoding response: %w", err))
+	}
+	return nil
+}
+
+// fail wraps err into an APIError for endpoint
+func (c *Client) fail(endpoint string, err error) error {
+	return &APIError{Host: c.host, Endpoint: endpoint, Err: err}
+}
@@ -0,0 +1,143 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/burningsunrise/tplink-exporter/fakeswitch"
+	"github.com/burningsunrise/tplink-exporter/parser"
+)
+
+func TestMalformedResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		fixture  string
+		response string
+		run      func(*Tplink, context.Context, SwitchAPI) error
+	}{
+		{"not json", "port_unit1.json", `<html>`, (*Tplink).SwitchPorts},
+		{"data not an object", "trafficMonitorCfgDetailModel_1-0-1.json",
+			`{"data":[1,2],"success":true}`, (*Tplink).SwitchPortStatistics},
+		{"counter not a number", "trafficMonitorCfgDetailModel_1-0-1.json",
+			`{"data":{"bytesRx":"n/a"},"success":true}`, (*Tplink).SwitchPortStatistics},
+		{"key not a string", "vlanPortCfg_unit1.json",
+			`{"data":[{"key":1,"pvid":1}],"success":true}`, (*Tplink).SwitchPortVlanCfg},
+		{"ports missing", "vlanMacCfgModel_unit1.json",
+			`{"data":{"ports":12},"success":true}`, (*Tplink).SwitchMacVlanCfgModel},
+		{"rejected", "cpuInfo_unit1.json",
+			`{"success":false,"errorcode":-1}`, (*Tplink).SwitchCpu},
+		{"unit 1 rejected", "systemSummaryConfig_unit1.json",
+			`{"success":false,"errorcode":-1}`, (*Tplink).SwitchSystem},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+			defer fake.Close()
+			fake.Replace(test.fixture, test.response)
+
+			api := NewClient(fake.Host(), fake.Client(), parser.DefaultMaxRequests)
+			tplink := Tplink{DnsName: fake.Host()}
+			if err := tplink.Login(context.Background(), api, credentials); err != nil {
+				t.Fatal(err)
+			}
+			if err := tplink.SwitchPorts(context.Background(), api); err != nil && test.fixture != "port_unit1.json" {
+				t.Fatal(err)
+			}
+
+			err := test.run(&tplink, context.Background(), api)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("got %v, want an APIError", err)
+			}
+			if apiErr.Host != fake.Host() || apiErr.Endpoint == "" {
+				t.Errorf("error does not name host and endpoint: %v", err)
+			}
+		})
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	api := NewClient(strings.TrimPrefix(server.URL, "https://"), server.Client(), parser.DefaultMaxRequests)
+	_, err := api.Login(context.Background(), credentials)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("got %v, want the HTTP status", err)
+	}
+}
+
+func TestStringsContainingData(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+	fake.Replace("vlanPortDetailCfg_1-0-2.json",
+		`{"data":[{"key":1,"vlanId":20,"name":"datacenter"}],"success":true,"errorcode":0,"timeout":false}`)
+	fake.Replace("vlanMacCfg.json",
+		`{"data":[{"key":"1","mac":"00-11-22-33-44-55","note":"metadata server","vlanId":20,"vlanName":"data"}],"success":true,"errorcode":0,"timeout":false}`)
+
+	tplink := poll(t, NewClient(fake.Host(), fake.Client(), parser.DefaultMaxRequests))
+	port := tplink.Ports[1]
+	if len(port.Vlans) != 1 || port.Vlans[0].Name != "datacenter" {
+		t.Errorf("got vlans %+v, want datacenter", port.Vlans)
+	}
+	if len(port.Macvlan) != 1 || port.Macvlan[0].Note != "metadata server" || port.Macvlan[0].VlanName != "data" {
+		t.Errorf("got mac vlans %+v", port.Macvlan)
+	}
+}
+
+func TestMacVlansFetchedOncePerPoll(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+	fake.Replace("vlanMacCfgModel_unit1.json",
+		`{"data":{"ports":"1/0/2,1/0/3"},"success":true,"errorcode":0,"timeout":false}`)
+	fake.Replace("vlanMacCfg.json", `{"data":[`+
+		`{"key":"1","mac":"00-11-22-33-44-55","note":"printer","vlanId":20,"vlanName":"printers"},`+
+		`{"key":"1/0/3","mac":"00-11-22-33-44-66","note":"camera","vlanId":30,"vlanName":"cameras"}`+
+		`],"success":true,"errorcode":0,"timeout":false}`)
+
+	tplink := poll(t, NewClient(fake.Host(), fake.Client(), parser.DefaultMaxRequests))
+	if requests := fake.Requests("vlanMacCfg"); requests != 1 {
+		t.Errorf("vlanMacCfg requested %d times, want once", requests)
+	}
+	if got := tplink.Ports[1].Macvlan; len(got) != 1 || got[0].Note != "printer" {
+		t.Errorf("got mac vlans %+v on 1/0/2, want the printer", got)
+	}
+	if got := tplink.Ports[2].Macvlan; len(got) != 2 || got[1].Note != "camera" {
+		t.Errorf("got mac vlans %+v on 1/0/3, want the printer and the camera", got)
+	}
+	if got := tplink.Ports[0].Macvlan; len(got) != 0 {
+		t.Errorf("got mac vlans %+v on 1/0/1, want none", got)
+	}
+}
+
+func TestPasswordsWithSpecialCharacters(t *testing.T) {
+	passwords := []string{
+		`pa"ss`,
+		`back\slash`,
+		`"}, "username": "root`,
+		"tab\tnewline\n",
+		"<admin&amp;>",
+		"pässwörd€",
+	}
+	for _, password := range passwords {
+		t.Run(password, func(t *testing.T) {
+			fake := fakeswitch.NewFromDir(fixtures, credentials.User, password)
+			defer fake.Close()
+
+			api := NewClient(fake.Host(), fake.Client(), parser.DefaultMaxRequests)
+			module := parser.Module{User: credentials.User, Password: password}
+			if _, err := api.Login(context.Background(), module); err != nil {
+				t.Fatalf("login with %q: %v", password, err)
+			}
+			if _, err := api.Login(context.Background(), credentials); err == nil {
+				t.Fatalf("login with the wrong password succeeded")
+			}
+		})
+	}
+}
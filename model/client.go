@@ -2,17 +2,71 @@ package model
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net/http"
-	"time"
+	"net/url"
 )
 
+// ErrSessionExpired is returned when the switch no longer accepts the _tid_
+// of the session, the caller has to log in again
+var ErrSessionExpired = errors.New("session expired")
+
+// Unreachable reports whether err is a request the switch did not answer at
+// all, e.g. because it is powered off, rather than an answer it rejected
+func Unreachable(err error) bool {
+	var u *url.Error
+	return errors.As(err, &u)
+}
+
+// APIError is returned by every SwitchAPI call that failed, it names the
+// switch and endpoint together with the reason
+type APIError struct {
+	Host     string
+	Endpoint string
+	Err      error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Host, e.Endpoint, e.Err)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// envelope holds the status fields every response carries, the firmware sets
+// timeout when the request was made with an expired session
+type envelope struct {
+	Success   bool `json:"success"`
+	Errorcode int  `json:"errorcode"`
+	Timeout   bool `json:"timeout"`
+}
+
+// transport is used by every client made by HttpClient, Record and Replay
+// replace it at startup
+var transport http.RoundTripper = &http.Transport{
+	MaxIdleConnsPerHost: 20,
+	TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+}
+
+// Record makes clients write every request and response to dir, see Recorder
+func Record(dir string) {
+	transport = &Recorder{Dir: dir, Next: transport}
+}
+
+// Replay makes clients answer from the recordings in dir instead of the
+// switches, see Replayer
+func Replay(dir string) {
+	transport = &Replayer{Dir: dir}
+}
+
+// HttpClient returns the client requests are sent with. It has no timeout of
+// its own, every request carries the deadline of the poll or probe in its
+// context, which may well be longer than a fixed timeout
 func HttpClient() *http.Client {
 	client := &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 20,
-			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
-		},
-		Timeout: 30 * time.Second,
+		Transport: transport,
 	}
 	return client
 }
@@ -0,0 +1,56 @@
+package model
+
+import "fmt"
+
+var duplexCfgNames = map[float64]string{
+	0: "auto",
+	1: "half",
+	2: "full",
+}
+
+var duplexLinkNames = map[float64]string{
+	1: "half",
+	2: "full",
+}
+
+var mediaTypeNames = map[float64]string{
+	0: "copper",
+	1: "fiber",
+}
+
+// Up reports whether the port has a link
+func (p Port) Up() bool {
+	return p.LinkStatus != 0
+}
+
+// AdminUp reports whether the port is enabled in the configuration
+func (p Port) AdminUp() bool {
+	return p.State != 0
+}
+
+// FlowControlEnabled reports whether flow control is configured on the port
+func (p Port) FlowControlEnabled() bool {
+	return p.FlowControl != 0
+}
+
+// Duplex returns the negotiated duplex mode, half, full or unknown
+func (p Port) Duplex() string {
+	return codeName(duplexLinkNames, p.DuplexLink)
+}
+
+// ConfiguredDuplex returns the configured duplex mode, auto, half, full or unknown
+func (p Port) ConfiguredDuplex() string {
+	return codeName(duplexCfgNames, p.DuplexCfg)
+}
+
+// Media returns the media type of the port, copper, fiber or unknown
+func (p Port) Media() string {
+	return codeName(mediaTypeNames, p.MediaType)
+}
+
+func codeName(names map[float64]string, code float64) string {
+	if name, ok := names[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown_%g", code)
+}
@@ -0,0 +1,210 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// redacted replaces credentials and session ids in recorded files
+const redacted = "REDACTED"
+
+// sensitiveKeys are the JSON keys whose values never end up on disk
+var sensitiveKeys = map[string]bool{"username": true, "password": true, "_tid_": true}
+
+// FixtureNames returns the file names a request to endpoint with payload is
+// stored under, most specific first. Requests selecting a port, tab or unit
+// are stored as <endpoint>_<selector>.json with the slashes of a port
+// replaced by dashes, everything else as <endpoint>.json, the same layout
+// fakeswitch reads its fixtures from
+func FixtureNames(endpoint string, payload []byte) []string {
+	var selectors map[string]interface{}
+	json.Unmarshal(payload, &selectors)
+
+	var names []string
+	for _, key := range []string{"port", "tab", "unit"} {
+		if value, ok := selectors[key].(string); ok {
+			names = append(names, endpoint+"_"+strings.ReplaceAll(value, "/", "-")+".json")
+		}
+	}
+	return append(names, endpoint+".json")
+}
+
+// endpointOf returns the endpoint of a request to /data/<endpoint>.json
+func endpointOf(req *http.Request) string {
+	return strings.TrimSuffix(path.Base(req.URL.Path), ".json")
+}
+
+// requestBody reads the payload of req and puts it back for the next reader
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Recorder is a RoundTripper that writes every request and response to Dir
+// before handing the response to the client. Each switch gets a directory
+// named after its host that can be used as a fakeswitch fixture set, the
+// responses are stored under FixtureNames and the requests next to them with
+// a .request.json suffix. Credentials and _tid_ are redacted from both
+type Recorder struct {
+	Dir  string
+	Next http.RoundTripper
+}
+
+// recordedRequest is what a .request.json file holds
+type recordedRequest struct {
+	Method string          `json:"method"`
+	URL    string          `json:"url"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	payload, err := requestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err := r.record(req, payload, body); err != nil {
+		log.WithFields(log.Fields{
+			"host":     req.URL.Host,
+			"endpoint": endpointOf(req),
+		}).Warn("could not record response: ", err)
+	}
+	return res, nil
+}
+
+func (r *Recorder) record(req *http.Request, payload, body []byte) error {
+	dir := filepath.Join(r.Dir, req.URL.Host)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	name := FixtureNames(endpointOf(req), payload)[0]
+
+	url := *req.URL
+	query := url.Query()
+	if query.Get("_tid_") != "" {
+		query.Set("_tid_", redacted)
+	}
+	url.RawQuery = query.Encode()
+	request := recordedRequest{Method: req.Method, URL: url.String()}
+	if len(payload) > 0 {
+		request.Body = redact(payload)
+	}
+	recorded, err := json.MarshalIndent(request, "", "  ")
+	if err != nil {
+		return err
+	}
+	requestName := strings.TrimSuffix(name, ".json") + ".request.json"
+	if err := ioutil.WriteFile(filepath.Join(dir, requestName), recorded, 0o644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), redact(body), 0o644)
+}
+
+// redact replaces the values of sensitiveKeys in a JSON document, anything
+// that is not JSON or has nothing to redact is returned unchanged
+func redact(body []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var document interface{}
+	if decoder.Decode(&document) != nil || !redactValue(document) {
+		return body
+	}
+	redactedBody, err := json.Marshal(document)
+	if err != nil {
+		return body
+	}
+	return redactedBody
+}
+
+// redactValue redacts value in place and reports whether anything changed
+func redactValue(value interface{}) bool {
+	changed := false
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if sensitiveKeys[key] {
+				v[key] = redacted
+				changed = true
+				continue
+			}
+			changed = redactValue(field) || changed
+		}
+	case []interface{}:
+		for _, field := range v {
+			changed = redactValue(field) || changed
+		}
+	}
+	return changed
+}
+
+// Replayer is a RoundTripper that answers requests from the files written by
+// a Recorder in Dir instead of contacting the switch. Any credentials log in,
+// requests without a recording are answered with success set to false the
+// way the firmware answers for a missing stack unit
+type Replayer struct {
+	Dir string
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	payload, err := requestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := endpointOf(req)
+	body := []byte(`{"success":false,"errorcode":-1,"timeout":false}`)
+	if endpoint == "logout" {
+		body = []byte(`{"success":true,"errorcode":0,"timeout":false}`)
+	}
+
+	dir := filepath.Join(r.Dir, req.URL.Host)
+	found := false
+	for _, name := range FixtureNames(endpoint, payload) {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, name)); err == nil {
+			body = data
+			found = true
+			break
+		}
+	}
+	if !found && endpoint == "login" {
+		return nil, fmt.Errorf("no recorded login for %s in %s", req.URL.Host, r.Dir)
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,71 @@
+package model
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/burningsunrise/tplink-exporter/fakeswitch"
+	"github.com/burningsunrise/tplink-exporter/parser"
+)
+
+// poll runs every stage against api and returns what was gathered
+func poll(t *testing.T, api SwitchAPI) Tplink {
+	t.Helper()
+	tplink := Tplink{DnsName: api.Host()}
+	if err := tplink.Login(context.Background(), api, credentials); err != nil {
+		t.Fatal(err)
+	}
+	steps := []func(context.Context, SwitchAPI) error{
+		tplink.SwitchSystem,
+		tplink.SwitchPorts,
+		tplink.SwitchPortStatistics,
+		tplink.SwitchPortVlans,
+		tplink.SwitchPortVlanCfg,
+		tplink.SwitchMacVlanCfgModel,
+		tplink.SwitchMemory,
+		tplink.SwitchCpu,
+	}
+	for _, step := range steps {
+		if err := step(context.Background(), api); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tplink.Session = Session{}
+	return tplink
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+	dir := t.TempDir()
+
+	recorder := &http.Client{Transport: &Recorder{Dir: dir, Next: fake.Client().Transport}}
+	recorded := poll(t, NewClient(fake.Host(), recorder, parser.DefaultMaxRequests))
+
+	files, err := filepath.Glob(filepath.Join(dir, fake.Host(), "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("nothing recorded: %v", err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, secret := range []string{credentials.Password, "fake0000"} {
+			if strings.Contains(string(data), secret) {
+				t.Errorf("%s contains %q", filepath.Base(file), secret)
+			}
+		}
+	}
+
+	replayer := &http.Client{Transport: &Replayer{Dir: dir}}
+	replayed := poll(t, NewClient(fake.Host(), replayer, parser.DefaultMaxRequests))
+	if !reflect.DeepEqual(recorded, replayed) {
+		t.Errorf("replay differs from recording\nrecorded: %+v\nreplayed: %+v", recorded, replayed)
+	}
+}
@@ -0,0 +1,137 @@
+package model
+
+import (
+	"context"
+	"sync"
+
+	"github.com/burningsunrise/tplink-exporter/parser"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// session is a cached web session together with the API it was created on
+type session struct {
+	user    string
+	api     SwitchAPI
+	session Session
+}
+
+// SessionManager caches the web session of every switch, so a poll only logs
+// in when the switch expired the previous session instead of filling the
+// admin session table. Logins to one switch are serialized, concurrent polls
+// wait for the session the first one creates
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]session
+	logins   map[string]chan struct{}
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{sessions: map[string]session{}, logins: map[string]chan struct{}{}}
+}
+
+// lock takes the login lock of host, it returns the function releasing it or
+// the error of ctx when ctx is done first
+func (s *SessionManager) lock(ctx context.Context, host string) (func(), error) {
+	s.mu.Lock()
+	login, ok := s.logins[host]
+	if !ok {
+		login = make(chan struct{}, 1)
+		s.logins[host] = login
+	}
+	s.mu.Unlock()
+
+	select {
+	case login <- struct{}{}:
+		return func() { <-login }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Login reuses the cached session of the switch when it was created for the
+// same user, otherwise it logs in and caches the new session
+func (s *SessionManager) Login(ctx context.Context, t *Tplink, api SwitchAPI, m parser.Module) error {
+	unlock, err := s.lock(ctx, api.Host())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s.mu.Lock()
+	cached, ok := s.sessions[api.Host()]
+	s.mu.Unlock()
+	if ok && cached.user == m.User {
+		t.Session = cached.session
+		return nil
+	}
+	if ok {
+		s.logout(ctx, cached)
+	}
+	return s.login(ctx, t, api, m)
+}
+
+// Relogin logs in again after the switch expired the session in t. When
+// another poll already replaced that session its new session is reused
+func (s *SessionManager) Relogin(ctx context.Context, t *Tplink, api SwitchAPI, m parser.Module) error {
+	unlock, err := s.lock(ctx, api.Host())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s.mu.Lock()
+	cached, ok := s.sessions[api.Host()]
+	s.mu.Unlock()
+	if ok && cached.user == m.User && cached.session.Tid != t.Session.Tid {
+		t.Session = cached.session
+		return nil
+	}
+	return s.login(ctx, t, api, m)
+}
+
+// login logs in to the switch and caches the session, the caller holds the
+// login lock of the switch
+func (s *SessionManager) login(ctx context.Context, t *Tplink, api SwitchAPI, m parser.Module) error {
+	s.mu.Lock()
+	delete(s.sessions, api.Host())
+	s.mu.Unlock()
+
+	if err := t.Login(ctx, api, m); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.sessions[api.Host()] = session{user: m.User, api: api, session: t.Session}
+	s.mu.Unlock()
+	return nil
+}
+
+// Forget drops the cached session of host when it is still session, without
+// logging out as the switch is not answering. The next poll logs in again
+func (s *SessionManager) Forget(host string, session Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cached, ok := s.sessions[host]; ok && cached.session.Tid == session.Tid {
+		delete(s.sessions, host)
+	}
+}
+
+// LogoutAll ends every cached session, it is called on shutdown
+func (s *SessionManager) LogoutAll(ctx context.Context) {
+	s.mu.Lock()
+	sessions := s.sessions
+	s.sessions = map[string]session{}
+	s.mu.Unlock()
+
+	for _, cached := range sessions {
+		s.logout(ctx, cached)
+	}
+}
+
+func (s *SessionManager) logout(ctx context.Context, cached session) {
+	if err := cached.api.Logout(ctx, cached.session); err != nil {
+		log.WithFields(log.Fields{
+			"logout": cached.api.Host(),
+		}).Error(err)
+	}
+}
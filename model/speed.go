@@ -0,0 +1,124 @@
+package model
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// UnknownSpeed is returned for speed codes missing from the firmwares table
+const UnknownSpeed = -1
+
+// speedTable maps the speedLink or speedCfg codes of a firmware to bits per
+// second, duplex is reported separately in duplexLink and duplexCfg
+type speedTable map[float64]float64
+
+// firmware3LinkSpeeds holds the speedLink codes the original port parser
+// documented for 3.x firmware, 0 and 1 = 0m, 2 = 100m, 3 = 1000m. The codes
+// of 10M, 2.5G and 10G links have not been confirmed by a capture yet, they
+// are reported as unknown until one is added
+var firmware3LinkSpeeds = speedTable{
+	0: 0,
+	1: 0,
+	2: 100e6,
+	3: 1e9,
+}
+
+// firmware3CfgSpeeds holds the speedCfg codes, 0 is auto negotiation. 1 is
+// left out as it is not known whether it means auto or a fixed 10M, a port
+// configured with it would otherwise look auto negotiated
+var firmware3CfgSpeeds = speedTable{
+	0: 0,
+	2: 100e6,
+	3: 1e9,
+}
+
+// speedTables is searched in order for the first firmware version prefix that
+// matches, firmware that is not listed falls back to defaultSpeeds. Add a
+// table only for codes taken from a -record capture of that firmware
+var speedTables = []struct {
+	prefix string
+	link   speedTable
+	cfg    speedTable
+}{
+	{"3.", firmware3LinkSpeeds, firmware3CfgSpeeds},
+}
+
+var defaultSpeeds = speedTables[0]
+
+// unknownSpeeds remembers the firmware, field and code of the warnings given
+var unknownSpeeds sync.Map
+
+// Firmware returns the firmware version of the first unit
+func (t *Tplink) Firmware() string {
+	if len(t.Units) == 0 {
+		return ""
+	}
+	return t.Units[0].Data.FwVersion
+}
+
+// speeds returns the speedLink and speedCfg tables matching the switches
+// firmware
+func (t *Tplink) speeds() (link, cfg speedTable) {
+	for _, s := range speedTables {
+		if strings.HasPrefix(t.Firmware(), s.prefix) {
+			return s.link, s.cfg
+		}
+	}
+	return defaultSpeeds.link, defaultSpeeds.cfg
+}
+
+// LinkSpeed returns the negotiated speed of the port in bits per second, 0
+// when the link is down and UnknownSpeed when the code is not in the table.
+// A port with a link whose code decodes to 0 is reported as UnknownSpeed, it
+// is a speed the table does not know rather than no speed at all
+func (t *Tplink) LinkSpeed(p Port) float64 {
+	link, _ := t.speeds()
+	speed, ok := link[p.SpeedLink]
+	if !ok || (speed == 0 && p.Up()) {
+		return UnknownSpeed
+	}
+	return speed
+}
+
+// ConfiguredSpeed returns the configured speed of the port in bits per
+// second, 0 for auto negotiation and UnknownSpeed when the code is not in
+// the table
+func (t *Tplink) ConfiguredSpeed(p Port) float64 {
+	_, cfg := t.speeds()
+	if speed, ok := cfg[p.SpeedCfg]; ok {
+		return speed
+	}
+	return UnknownSpeed
+}
+
+// warnUnknownSpeeds logs the speed codes of the ports that cannot be decoded,
+// each code only once per firmware so polls do not repeat it forever
+func (t *Tplink) warnUnknownSpeeds() {
+	for _, port := range t.Ports {
+		codes := map[string]float64{}
+		if t.LinkSpeed(port) == UnknownSpeed {
+			codes["speedLink"] = port.SpeedLink
+		}
+		if t.ConfiguredSpeed(port) == UnknownSpeed {
+			codes["speedCfg"] = port.SpeedCfg
+		}
+		for field, code := range codes {
+			key := struct {
+				firmware, field string
+				code            float64
+			}{t.Firmware(), field, code}
+			if _, seen := unknownSpeeds.LoadOrStore(key, true); seen {
+				continue
+			}
+			log.WithFields(log.Fields{
+				"host":     t.DnsName,
+				"port":     port.Port,
+				"field":    field,
+				"code":     code,
+				"firmware": t.Firmware(),
+			}).Warn("unknown port speed code, please report it together with the firmware version")
+		}
+	}
+}
@@ -1,329 +1,320 @@
 package model
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net/http"
-	"strconv"
+	"context"
 	"strings"
+	"sync"
 
 	"github.com/burningsunrise/tplink-exporter/parser"
 )
 
+// Tplink is everything gathered from a switch during one poll
 type Tplink struct {
-	Data struct {
-		Tid               string    `json:"_tid_"`
-		UsrLvl            int       `json:"usrLvl"`
-		PwdNeedChange     int       `json:"pwdNeedChange"`
-		Eight02xSta       float64   `json:"_802x_sta"`
-		BlVersion         string    `json:"bl_version"`
-		ContactInfo       string    `json:"contact_info"`
-		DevLoc            string    `json:"dev_loc"`
-		DevName           string    `json:"dev_name"`
-		DhcpRelaySta      float64   `json:"dhcp_relay_sta"`
-		FanFlag           float64   `json:"fan_flag"`
-		FanSpeed          string    `json:"fan_speed"`
-		FanSta            float64   `json:"fan_sta"`
-		FwVersion         string    `json:"fw_version"`
-		HwVersion         string    `json:"hw_version"`
-		IgmpSnoopingSta   float64   `json:"igmp_snooping_sta"`
-		JumboFrameSta     float64   `json:"jumbo_frame_sta"`
-		MacAddress        string    `json:"mac_address"`
-		MaxTemp           float64   `json:"max_temp"`
-		MldSnoopingSta    float64   `json:"mld_snooping_sta"`
-		RunTime           string    `json:"run_time"`
-		SeNumber          string    `json:"se_number"`
-		SerialPortSetting float64   `json:"serial_port_setting"`
-		SnmpSta           float64   `json:"snmp_sta"`
-		SntpSta           float64   `json:"sntp_sta"`
-		SpanningTreeSta   float64   `json:"spanning_tree_sta"`
-		SSHSta            float64   `json:"ssh_sta"`
-		SysDescription    string    `json:"sys_description"`
-		SysTime           string    `json:"sys_time"`
-		TelnetSta         float64   `json:"telnet_sta"`
-		TemSta            float64   `json:"tem_sta"`
-		Temperature       float64   `json:"temperature"`
-		WebSta            float64   `json:"web_sta"`
-		Memory            []float64 `json:"memory"`
-		Cpu               []float64 `json:"cpu"`
-	} `json:"data"`
-	Ports []struct {
-		DuplexCfg      float64 `json:"duplexCfg"`
-		DuplexLink     float64 `json:"duplexLink"`
-		FlowControl    float64 `json:"flowControl"`
-		Include        float64 `json:"include"`
-		Lines          float64 `json:"lines"`
-		LinkStatus     float64 `json:"linkStatus"`
-		MediaType      float64 `json:"mediaType"`
-		Port           string  `json:"port"`
-		SpeedCfg       float64 `json:"speedCfg"`
-		SpeedLink      float64 `json:"speedLink"` //0 and 1 = 0m, 2 = 100m, 3 = 1000m
-		State          float64 `json:"state"`
-		Type           float64 `json:"type"`
-		BroadcastRx    float64 `json:"broadcastRx"`
-		MulticastRx    float64 `json:"multicastRx"`
-		UnicastRx      float64 `json:"unicastRx"`
-		BroadcastTx    float64 `json:"broadcastTx"`
-		MulticastTx    float64 `json:"multicastTx"`
-		UnicastTx      float64 `json:"unicastTx"`
-		OversizePktsTx float64 `json:"oversizePktsTx"`
-		ErrorsTx       float64 `json:"errorsTx"`
-		PktsTx         float64 `json:"pktsTx"`
-		BytesTx        float64 `json:"bytesTx"`
-		Pkts64         float64 `json:"Pkts64"`
-		Pkts65         float64 `json:"Pkts65"`
-		Pkts128        float64 `json:"Pkts128"`
-		Pkts256        float64 `json:"Pkts256"`
-		Pkts512        float64 `json:"Pkts512"`
-		Pkts1023       float64 `json:"Pkts1023"`
-		UndersizePkts  float64 `json:"undersizePkts"`
-		ErrorsRx       float64 `json:"errorsRx"`
-		OversizePktsRx float64 `json:"oversizePktsRx"`
-		PktsRx         float64 `json:"pktsRx"`
-		BytesRx        float64 `json:"bytesRx"`
-		Pvid           float64 `json:"pvid"`
-		IngressCheck   float64 `json:"ingress_check"`
-		FrameType      float64 `json:"frame_type"`
-		Lag            string  `json:"lag"`
-		Vlans          []struct {
-			Key    float64 `json:"key"`
-			Name   string  `json:"name"`
-			VlanID float64 `json:"vlanId"`
-		} `json:"vlans"`
-		Macvlan []struct {
-			Key      string  `json:"key"`
-			Mac      string  `json:"mac"`
-			Note     string  `json:"note"`
-			VlanID   float64 `json:"vlanId"`
-			VlanName string  `json:"vlanName"`
-		} `json:"macvlan"`
-	} `json:"ports"`
-	Errorcode int  `json:"errorcode"`
-	Success   bool `json:"success"`
-	Timeout   bool `json:"timeout"`
-	DnsName   string
+	Session Session
+	Units   []Unit
+	Ports   []Port
+	DnsName string
 }
 
-func (t *Tplink) Login(y parser.YamlConfig, c *http.Client) error {
+// MaxUnits is the largest stack a switch is probed for
+const MaxUnits = 8
 
-	url := fmt.Sprintf("https://%s/data/login.json", t.DnsName)
-	payload := strings.NewReader(
-		fmt.Sprintf(
-			"{\"username\":\"%s\",\"password\":\"%s\",\"operation\":\"write\"}",
-			y.User, y.Password),
-	)
+// Unit is a single member of a stack, a standalone switch only has unit 1
+type Unit struct {
+	ID   int
+	Data System
+}
 
-	req, _ := http.NewRequest("POST", url, payload)
-	req.Header.Add("Content-Type", "application/json")
-	res, err := c.Do(req)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
+// System is the system summary, memory and cpu of a unit
+type System struct {
+	Eight02xSta       float64   `json:"_802x_sta"`
+	BlVersion         string    `json:"bl_version"`
+	ContactInfo       string    `json:"contact_info"`
+	DevLoc            string    `json:"dev_loc"`
+	DevName           string    `json:"dev_name"`
+	DhcpRelaySta      float64   `json:"dhcp_relay_sta"`
+	FanFlag           float64   `json:"fan_flag"`
+	FanSpeed          string    `json:"fan_speed"`
+	FanSta            float64   `json:"fan_sta"`
+	FwVersion         string    `json:"fw_version"`
+	HwVersion         string    `json:"hw_version"`
+	IgmpSnoopingSta   float64   `json:"igmp_snooping_sta"`
+	JumboFrameSta     float64   `json:"jumbo_frame_sta"`
+	MacAddress        string    `json:"mac_address"`
+	MaxTemp           float64   `json:"max_temp"`
+	MldSnoopingSta    float64   `json:"mld_snooping_sta"`
+	RunTime           string    `json:"run_time"`
+	SeNumber          string    `json:"se_number"`
+	SerialPortSetting float64   `json:"serial_port_setting"`
+	SnmpSta           float64   `json:"snmp_sta"`
+	SntpSta           float64   `json:"sntp_sta"`
+	SpanningTreeSta   float64   `json:"spanning_tree_sta"`
+	SSHSta            float64   `json:"ssh_sta"`
+	SysDescription    string    `json:"sys_description"`
+	SysTime           string    `json:"sys_time"`
+	TelnetSta         float64   `json:"telnet_sta"`
+	TemSta            float64   `json:"tem_sta"`
+	Temperature       float64   `json:"temperature"`
+	WebSta            float64   `json:"web_sta"`
+	Memory            []float64 `json:"memory"`
+	Cpu               []float64 `json:"cpu"`
+}
 
-	json.Unmarshal(body, &t)
-	return nil
+type Port struct {
+	DuplexCfg   float64 `json:"duplexCfg"`
+	DuplexLink  float64 `json:"duplexLink"`
+	FlowControl float64 `json:"flowControl"`
+	Include     float64 `json:"include"`
+	Lines       float64 `json:"lines"`
+	LinkStatus  float64 `json:"linkStatus"`
+	MediaType   float64 `json:"mediaType"`
+	Port        string  `json:"port"`
+	SpeedCfg    float64 `json:"speedCfg"`
+	SpeedLink   float64 `json:"speedLink"` // decoded with LinkSpeed
+	State       float64 `json:"state"`
+	Type        float64 `json:"type"`
+	TrafficStatistics
+	VlanCfg
+	Vlans   []Vlan    `json:"vlans"`
+	Macvlan []MacVlan `json:"macvlan"`
 }
 
-func (t *Tplink) SwitchSystem(c *http.Client) error {
-	url := fmt.Sprintf("https://%s/data/systemSummaryConfig.json?_tid_=%s&usrLvl=%d", t.DnsName, t.Data.Tid, t.Data.UsrLvl)
-	payload := strings.NewReader("{\"operation\":\"read\",\"tab\":\"unit1\"}")
+// TrafficStatistics are the counters of a port from trafficMonitorCfgDetailModel.json
+type TrafficStatistics struct {
+	BroadcastRx    float64 `json:"broadcastRx"`
+	MulticastRx    float64 `json:"multicastRx"`
+	UnicastRx      float64 `json:"unicastRx"`
+	BroadcastTx    float64 `json:"broadcastTx"`
+	MulticastTx    float64 `json:"multicastTx"`
+	UnicastTx      float64 `json:"unicastTx"`
+	OversizePktsTx float64 `json:"oversizePktsTx"`
+	ErrorsTx       float64 `json:"errorsTx"`
+	PktsTx         float64 `json:"pktsTx"`
+	BytesTx        float64 `json:"bytesTx"`
+	Pkts64         float64 `json:"Pkts64"`
+	Pkts65         float64 `json:"Pkts65"`
+	Pkts128        float64 `json:"Pkts128"`
+	Pkts256        float64 `json:"Pkts256"`
+	Pkts512        float64 `json:"Pkts512"`
+	Pkts1023       float64 `json:"Pkts1023"`
+	UndersizePkts  float64 `json:"undersizePkts"`
+	ErrorsRx       float64 `json:"errorsRx"`
+	OversizePktsRx float64 `json:"oversizePktsRx"`
+	PktsRx         float64 `json:"pktsRx"`
+	BytesRx        float64 `json:"bytesRx"`
+}
 
-	req, _ := http.NewRequest("POST", url, payload)
-	req.Header.Add("Content-Type", "application/json")
-	res, err := c.Do(req)
-	if err != nil {
-		return err
-	}
+// VlanCfg is the 802.1Q configuration of a port from vlanPortCfg.json
+type VlanCfg struct {
+	Pvid         float64 `json:"pvid"`
+	IngressCheck float64 `json:"ingress_check"`
+	FrameType    float64 `json:"frame_type"`
+	Lag          string  `json:"lag"`
+}
 
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
+type Vlan struct {
+	Key    float64 `json:"key"`
+	Name   string  `json:"name"`
+	VlanID float64 `json:"vlanId"`
+}
 
-	json.Unmarshal(body, &t)
-	return nil
+type MacVlan struct {
+	Key      string  `json:"key"`
+	Mac      string  `json:"mac"`
+	Note     string  `json:"note"`
+	VlanID   float64 `json:"vlanId"`
+	VlanName string  `json:"vlanName"`
 }
 
-func (t *Tplink) SwitchPorts(c *http.Client) error {
-	url := fmt.Sprintf("https://%s/data/port.json?_tid_=%s&usrLvl=%d", t.DnsName, t.Data.Tid, t.Data.UsrLvl)
-	payload := strings.NewReader("{\"operation\":\"load\",\"special\":\"display\",\"tab\":\"unit1\"}")
-	req, _ := http.NewRequest("POST", url, payload)
-	req.Header.Add("Content-Type", "application/json")
-	res, err := c.Do(req)
+// Login logs in to the switch and keeps the session in t
+func (t *Tplink) Login(ctx context.Context, api SwitchAPI, m parser.Module) error {
+	session, err := api.Login(ctx, m)
 	if err != nil {
 		return err
 	}
-
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
-	var jbody string = strings.ReplaceAll(string(body), "data", "ports")
-	json.Unmarshal([]byte(jbody), &t)
-	for index, port := range t.Ports {
-		switch port.SpeedLink {
-		case 2:
-			t.Ports[index].SpeedLink = 100
-		case 3:
-			t.Ports[index].SpeedLink = 1000
-		case 1:
-			t.Ports[index].SpeedLink = 0
-		default:
-			t.Ports[index].SpeedLink = 0
-		}
-	}
+	t.Session = session
 	return nil
 }
 
-func (t *Tplink) SwitchPortStatistics(c *http.Client) error {
-	for index, portInfo := range t.Ports {
-		var jsonMap map[string]interface{}
-		url := fmt.Sprintf("https://%s/data/trafficMonitorCfgDetailModel.json?_tid_=%s&usrLvl=%d", t.DnsName, t.Data.Tid, t.Data.UsrLvl)
-		payload := strings.NewReader(fmt.Sprintf("{\"operation\":\"read\",\"port\":\"%s\"}", portInfo.Port))
-		req, _ := http.NewRequest("POST", url, payload)
-		req.Header.Add("Content-Type", "application/json")
-		res, err := c.Do(req)
+// SwitchSystem reads the system summary of every unit in the stack, units are
+// discovered by asking for the next unit until the switch has no answer
+func (t *Tplink) SwitchSystem(ctx context.Context, api SwitchAPI) error {
+	t.Units = nil
+	for id := 1; id <= MaxUnits; id++ {
+		system, found, err := api.SystemSummary(ctx, t.Session, id)
 		if err != nil {
 			return err
 		}
+		if id > 1 && !found {
+			break
+		}
+		t.Units = append(t.Units, Unit{ID: id, Data: system})
+	}
+	return nil
+}
 
-		defer res.Body.Close()
-		body, _ := ioutil.ReadAll(res.Body)
-		json.Unmarshal(body, &jsonMap)
-		dataMap := jsonMap["data"].(map[string]interface{})
-		for j, ma := range dataMap {
-			switch ma.(type) {
-			case string:
-				if s, err := strconv.ParseFloat(strings.Replace(ma.(string), ",", "", -1), 64); err == nil {
-					dataMap[j] = s
-				}
-			}
+// UnitIDs returns the units found by SwitchSystem, or unit 1 when discovery
+// did not run
+func (t *Tplink) UnitIDs() []int {
+	if len(t.Units) == 0 {
+		return []int{1}
+	}
+	ids := make([]int, 0, len(t.Units))
+	for _, unit := range t.Units {
+		ids = append(ids, unit.ID)
+	}
+	return ids
+}
+
+// unit returns the unit with the given id, adding it when it is missing
+func (t *Tplink) unit(id int) *Unit {
+	for index := range t.Units {
+		if t.Units[index].ID == id {
+			return &t.Units[index]
 		}
+	}
+	t.Units = append(t.Units, Unit{ID: id})
+	return &t.Units[len(t.Units)-1]
+}
 
-		theData, err := json.Marshal(dataMap)
+// SwitchPorts loads the ports of every unit
+func (t *Tplink) SwitchPorts(ctx context.Context, api SwitchAPI) error {
+	t.Ports = nil
+	for _, unit := range t.UnitIDs() {
+		ports, err := api.Ports(ctx, t.Session, unit)
 		if err != nil {
 			return err
 		}
-		json.Unmarshal(theData, &t.Ports[index])
+		t.Ports = append(t.Ports, ports...)
 	}
+	t.warnUnknownSpeeds()
 	return nil
 }
 
-func (t *Tplink) SwitchPortVlans(c *http.Client) error {
-	for index, portInfo := range t.Ports {
-		url := fmt.Sprintf("https://%s/data/vlanPortDetailCfg.json?_tid_=%s&usrLvl=%d", t.DnsName, t.Data.Tid, t.Data.UsrLvl)
-		payload := strings.NewReader(fmt.Sprintf("{\"operation\":\"load\",\"port\":\"%s\"}", portInfo.Port))
-		req, _ := http.NewRequest("POST", url, payload)
-		req.Header.Add("Content-Type", "application/json")
-		res, err := c.Do(req)
+// forEachPort calls fetch for every port concurrently, how many requests
+// actually run at once is limited by the api. The first error, or a cancelled
+// ctx, aborts the ports still waiting
+func (t *Tplink) forEachPort(ctx context.Context, fetch func(ctx context.Context, index int, port Port) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(t.Ports))
+	var wg sync.WaitGroup
+	for index, port := range t.Ports {
+		wg.Add(1)
+		go func(index int, port Port) {
+			defer wg.Done()
+			if err := fetch(ctx, index, port); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(index, port)
+	}
+	wg.Wait()
+	close(errs)
+	// the first error is the one that cancelled the others
+	return <-errs
+}
+
+// SwitchPortStatistics reads the counters of every port
+func (t *Tplink) SwitchPortStatistics(ctx context.Context, api SwitchAPI) error {
+	return t.forEachPort(ctx, func(ctx context.Context, index int, port Port) error {
+		stats, err := api.TrafficStatistics(ctx, t.Session, port.Port)
 		if err != nil {
 			return err
 		}
-
-		defer res.Body.Close()
-		body, _ := ioutil.ReadAll(res.Body)
-		var jbody string = strings.ReplaceAll(string(body), "data", "vlans")
-		json.Unmarshal([]byte(jbody), &t.Ports[index])
-	}
-	return nil
+		t.Ports[index].TrafficStatistics = stats
+		return nil
+	})
 }
 
-func (t *Tplink) SwitchPortVlanCfg(c *http.Client) error {
-	var jsonMap map[string][]interface{}
-	url := fmt.Sprintf("https://%s/data/vlanPortCfg.json?_tid_=%s&usrLvl=%d", t.DnsName, t.Data.Tid, t.Data.UsrLvl)
-	payload := strings.NewReader("{\"operation\":\"load\",\"tab\":\"unit1\"}")
-	req, _ := http.NewRequest("POST", url, payload)
-	req.Header.Add("Content-Type", "application/json")
-	res, err := c.Do(req)
-	if err != nil {
-		return err
-	}
+// SwitchPortVlans reads the VLANs of every port
+func (t *Tplink) SwitchPortVlans(ctx context.Context, api SwitchAPI) error {
+	return t.forEachPort(ctx, func(ctx context.Context, index int, port Port) error {
+		vlans, err := api.PortVlans(ctx, t.Session, port.Port)
+		if err != nil {
+			return err
+		}
+		t.Ports[index].Vlans = vlans
+		return nil
+	})
+}
 
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
-	json.Unmarshal(body, &jsonMap)
-	for index, portInfo := range t.Ports {
-		for _, x := range jsonMap["data"] {
-			if portInfo.Port == x.(map[string]interface{})["key"] {
-				t.Ports[index].Pvid = x.(map[string]interface{})["pvid"].(float64)
-				t.Ports[index].Lag = x.(map[string]interface{})["lag"].(string)
-				t.Ports[index].IngressCheck = x.(map[string]interface{})["ingress_check"].(float64)
-				t.Ports[index].FrameType = x.(map[string]interface{})["frame_type"].(float64)
+func (t *Tplink) SwitchPortVlanCfg(ctx context.Context, api SwitchAPI) error {
+	for _, unit := range t.UnitIDs() {
+		cfgs, err := api.PortVlanCfg(ctx, t.Session, unit)
+		if err != nil {
+			return err
+		}
+		for index, portInfo := range t.Ports {
+			if cfg, ok := cfgs[portInfo.Port]; ok {
+				t.Ports[index].VlanCfg = cfg
 			}
 		}
 	}
 	return nil
 }
 
-func (t *Tplink) SwitchMacVlanCfgModel(c *http.Client) error {
-	var jsonMap map[string]interface{}
-	url := fmt.Sprintf("https://%s/data/vlanMacCfgModel.json?_tid_=%s&usrLvl=%d", t.DnsName, t.Data.Tid, t.Data.UsrLvl)
-	payload := strings.NewReader("{\"operation\":\"read\",\"tab\":\"unit1\"}")
-	req, _ := http.NewRequest("POST", url, payload)
-	req.Header.Add("Content-Type", "application/json")
-	res, err := c.Do(req)
+func (t *Tplink) SwitchMacVlanCfgModel(ctx context.Context, api SwitchAPI) error {
+	enabled := map[string]bool{}
+	for _, unit := range t.UnitIDs() {
+		ports, err := api.MacVlanPorts(ctx, t.Session, unit)
+		if err != nil {
+			return err
+		}
+		for _, port := range ports {
+			enabled[port] = true
+		}
+	}
+	if len(enabled) == 0 {
+		return nil
+	}
+
+	// the table is global, read it once and hand every enabled port the
+	// entries that apply to it
+	macvlans, err := api.MacVlans(ctx, t.Session)
 	if err != nil {
 		return err
 	}
-
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
-	json.Unmarshal(body, &jsonMap)
-	ports := strings.Split(jsonMap["data"].(map[string]interface{})["ports"].(string), ",")
-	for index, portInfo := range t.Ports {
-		for _, x := range ports {
-			if portInfo.Port == x {
-				t.switchMacVlanCfg(c, index)
-			}
+	for index, port := range t.Ports {
+		if enabled[port.Port] {
+			t.Ports[index].Macvlan = macVlansOf(port.Port, macvlans)
 		}
 	}
 	return nil
 }
 
-func (t *Tplink) switchMacVlanCfg(c *http.Client, index int) error {
-	url := fmt.Sprintf("https://%s/data/vlanMacCfg.json?_tid_=%s&usrLvl=%d", t.DnsName, t.Data.Tid, t.Data.UsrLvl)
-	payload := strings.NewReader("{\"operation\":\"load\"}")
-	req, _ := http.NewRequest("POST", url, payload)
-	req.Header.Add("Content-Type", "application/json")
-	res, err := c.Do(req)
-	if err != nil {
-		return err
+// macVlansOf returns the entries of macvlans that apply to port, entries
+// whose key names a port only apply to that port and the others, keyed by
+// their row, to every port with MAC based VLANs enabled
+func macVlansOf(port string, macvlans []MacVlan) []MacVlan {
+	var entries []MacVlan
+	for _, m := range macvlans {
+		if !strings.Contains(m.Key, "/") || m.Key == port {
+			entries = append(entries, m)
+		}
 	}
-
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
-	var jbody string = strings.ReplaceAll(string(body), "data", "macvlan")
-	json.Unmarshal([]byte(jbody), &t.Ports[index])
-	return nil
+	return entries
 }
 
-func (t *Tplink) SwitchMemory(c *http.Client) error {
-	url := fmt.Sprintf("https://%s/data/memoryInfo.json?_tid_=%s&usrLvl=%d", t.DnsName, t.Data.Tid, t.Data.UsrLvl)
-	payload := strings.NewReader("{\"unit\":\"unit1\"}")
-	req, _ := http.NewRequest("POST", url, payload)
-	req.Header.Add("Content-Type", "application/json")
-	res, err := c.Do(req)
-	if err != nil {
-		return err
+func (t *Tplink) SwitchMemory(ctx context.Context, api SwitchAPI) error {
+	for _, unit := range t.UnitIDs() {
+		memory, err := api.Memory(ctx, t.Session, unit)
+		if err != nil {
+			return err
+		}
+		t.unit(unit).Data.Memory = memory
 	}
-
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
-	json.Unmarshal(body, &t)
 	return nil
 }
 
-func (t *Tplink) SwitchCpu(c *http.Client) error {
-	url := fmt.Sprintf("https://%s/data/cpuInfo.json?_tid_=%s&usrLvl=%d", t.DnsName, t.Data.Tid, t.Data.UsrLvl)
-	payload := strings.NewReader("{\"unit\":\"unit1\"}")
-	req, _ := http.NewRequest("POST", url, payload)
-	req.Header.Add("Content-Type", "application/json")
-	res, err := c.Do(req)
-	if err != nil {
-		return err
+func (t *Tplink) SwitchCpu(ctx context.Context, api SwitchAPI) error {
+	for _, unit := range t.UnitIDs() {
+		cpu, err := api.Cpu(ctx, t.Session, unit)
+		if err != nil {
+			return err
+		}
+		t.unit(unit).Data.Cpu = cpu
 	}
-
-	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
-	json.Unmarshal(body, &t)
 	return nil
 }
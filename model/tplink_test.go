@@ -0,0 +1,273 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/burningsunrise/tplink-exporter/fakeswitch"
+	"github.com/burningsunrise/tplink-exporter/parser"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+const fixtures = "../fakeswitch/fixtures/synthetic-standalone"
+
+var credentials = parser.Module{User: "admin", Password: "secret"}
+
+func TestSwitchAgainstFake(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+
+	api := NewClient(fake.Host(), fake.Client(), parser.DefaultMaxRequests)
+	tplink := Tplink{DnsName: fake.Host()}
+	steps := []struct {
+		name string
+		run  func(context.Context, SwitchAPI) error
+	}{
+		{"login", func(ctx context.Context, api SwitchAPI) error { return tplink.Login(ctx, api, credentials) }},
+		{"system", tplink.SwitchSystem},
+		{"ports", tplink.SwitchPorts},
+		{"portstats", tplink.SwitchPortStatistics},
+		{"portvlans", tplink.SwitchPortVlans},
+		{"portvlancfg", tplink.SwitchPortVlanCfg},
+		{"macvlancfg", tplink.SwitchMacVlanCfgModel},
+		{"memory", tplink.SwitchMemory},
+		{"cpu", tplink.SwitchCpu},
+	}
+	for _, step := range steps {
+		if err := step.run(context.Background(), api); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+	}
+
+	if len(tplink.Units) != 1 {
+		t.Fatalf("got %d units, want 1", len(tplink.Units))
+	}
+	unit := tplink.Units[0]
+	if unit.Data.MacAddress != "50-C7-BF-00-00-01" || unit.Data.Temperature != 42 {
+		t.Errorf("unexpected system summary %+v", unit.Data)
+	}
+	if len(unit.Data.Memory) == 0 || unit.Data.Memory[0] != 43 {
+		t.Errorf("got memory %v, want 43 first", unit.Data.Memory)
+	}
+	if len(unit.Data.Cpu) == 0 || unit.Data.Cpu[0] != 7 {
+		t.Errorf("got cpu %v, want 7 first", unit.Data.Cpu)
+	}
+
+	if len(tplink.Ports) != 6 {
+		t.Fatalf("got %d ports, want 6", len(tplink.Ports))
+	}
+	first := tplink.Ports[0]
+	if first.Port != "1/0/1" {
+		t.Fatalf("got first port %q, want 1/0/1", first.Port)
+	}
+	if first.UnicastRx != 98765432 || first.BytesTx != 151234567890 || first.ErrorsRx != 7 {
+		t.Errorf("thousands separators not parsed: %+v", first.TrafficStatistics)
+	}
+	if len(first.Vlans) != 2 || first.Vlans[1].VlanID != 10 || first.Vlans[1].Name != "servers" {
+		t.Errorf("got vlans %+v", first.Vlans)
+	}
+	if tplink.LinkSpeed(first) != 1e9 {
+		t.Errorf("got link speed %v, want 1e9", tplink.LinkSpeed(first))
+	}
+
+	second := tplink.Ports[1]
+	if second.Pvid != 20 || second.IngressCheck != 1 {
+		t.Errorf("got vlan config %+v", second.VlanCfg)
+	}
+	if len(second.Macvlan) != 1 || second.Macvlan[0].Mac != "00-11-22-33-44-55" {
+		t.Errorf("got mac vlans %+v", second.Macvlan)
+	}
+	if second.Duplex() != "half" {
+		t.Errorf("got duplex %q, want half", second.Duplex())
+	}
+}
+
+func TestLoginRejected(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+
+	api := NewClient(fake.Host(), fake.Client(), parser.DefaultMaxRequests)
+	if _, err := api.Login(context.Background(), parser.Module{User: "admin", Password: "wrong"}); err == nil {
+		t.Fatal("login with a wrong password succeeded")
+	}
+}
+
+func TestSessionManager(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+
+	api := NewClient(fake.Host(), fake.Client(), parser.DefaultMaxRequests)
+	sessions := NewSessionManager()
+	for i := 0; i < 3; i++ {
+		tplink := Tplink{DnsName: fake.Host()}
+		if err := sessions.Login(context.Background(), &tplink, api, credentials); err != nil {
+			t.Fatal(err)
+		}
+		if err := tplink.SwitchCpu(context.Background(), api); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fake.Logins() != 1 {
+		t.Errorf("got %d logins, want the session to be reused", fake.Logins())
+	}
+
+	fake.Expire()
+	tplink := Tplink{DnsName: fake.Host()}
+	if err := sessions.Login(context.Background(), &tplink, api, credentials); err != nil {
+		t.Fatal(err)
+	}
+	if err := tplink.SwitchCpu(context.Background(), api); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("got %v, want ErrSessionExpired", err)
+	}
+	if err := sessions.Relogin(context.Background(), &tplink, api, credentials); err != nil {
+		t.Fatal(err)
+	}
+	if err := tplink.SwitchCpu(context.Background(), api); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Logins() != 2 {
+		t.Errorf("got %d logins, want 2", fake.Logins())
+	}
+
+	sessions.LogoutAll(context.Background())
+	if fake.Logouts() != 1 {
+		t.Errorf("got %d logouts, want 1", fake.Logouts())
+	}
+}
+
+// TestSessionManagerConcurrentLogins polls one switch from several goroutines
+// without a cached session, only one of them may log in
+func TestSessionManagerConcurrentLogins(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+	fake.Delay(10 * time.Millisecond)
+
+	api := NewClient(fake.Host(), fake.Client(), parser.DefaultMaxRequests)
+	sessions := NewSessionManager()
+	poll := func(expired Session) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tplink := Tplink{DnsName: fake.Host(), Session: expired}
+				var err error
+				if expired.Tid == "" {
+					err = sessions.Login(context.Background(), &tplink, api, credentials)
+				} else {
+					// the poll got ErrSessionExpired with this session
+					err = sessions.Relogin(context.Background(), &tplink, api, credentials)
+				}
+				if err == nil {
+					err = tplink.SwitchCpu(context.Background(), api)
+				}
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	poll(Session{})
+	if fake.Logins() != 1 {
+		t.Errorf("got %d logins, want 1", fake.Logins())
+	}
+
+	// every poll finds the session expired, only the first one logs in again
+	var tplink Tplink
+	if err := sessions.Login(context.Background(), &tplink, api, credentials); err != nil {
+		t.Fatal(err)
+	}
+	fake.Expire()
+	poll(tplink.Session)
+	if fake.Logins() != 2 {
+		t.Errorf("got %d logins after the session expired, want 2", fake.Logins())
+	}
+
+	sessions.LogoutAll(context.Background())
+	if fake.Logouts() != 1 {
+		t.Errorf("got %d logouts, want 1", fake.Logouts())
+	}
+}
+
+func TestPortRequestsLimit(t *testing.T) {
+	fake := fakeswitch.NewFromDir(fixtures, credentials.User, credentials.Password)
+	defer fake.Close()
+	fake.Delay(20 * time.Millisecond)
+
+	api := NewClient(fake.Host(), fake.Client(), 3)
+	tplink := Tplink{DnsName: fake.Host()}
+	ctx := context.Background()
+	if err := tplink.Login(ctx, api, credentials); err != nil {
+		t.Fatal(err)
+	}
+	if err := tplink.SwitchPorts(ctx, api); err != nil {
+		t.Fatal(err)
+	}
+	if err := tplink.SwitchPortStatistics(ctx, api); err != nil {
+		t.Fatal(err)
+	}
+	if err := tplink.SwitchPortVlans(ctx, api); err != nil {
+		t.Fatal(err)
+	}
+
+	if peak := fake.PeakRequests(); peak != 3 {
+		t.Errorf("got %d requests at once, want 3", peak)
+	}
+	if tplink.Ports[0].BytesTx != 151234567890 || tplink.Ports[5].Vlans[0].Name != "System-VLAN" {
+		t.Errorf("port data not stored with its port: %+v", tplink.Ports)
+	}
+}
+
+func TestPortSpeeds(t *testing.T) {
+	tplink := Tplink{Units: []Unit{{ID: 1, Data: System{FwVersion: "3.0.3 Build 20200805 Rel.39151"}}}}
+	tests := []struct {
+		port      Port
+		link, cfg float64
+	}{
+		{Port{LinkStatus: 0, SpeedLink: 0, SpeedCfg: 0}, 0, 0},
+		{Port{LinkStatus: 1, SpeedLink: 3, SpeedCfg: 0}, 1e9, 0},
+		{Port{LinkStatus: 1, SpeedLink: 2, SpeedCfg: 2}, 100e6, 100e6},
+		// a link reported with a speed of 0 is not a port without speed
+		{Port{LinkStatus: 1, SpeedLink: 1, SpeedCfg: 1}, UnknownSpeed, UnknownSpeed},
+		{Port{LinkStatus: 1, SpeedLink: 4, SpeedCfg: 0}, UnknownSpeed, 0},
+	}
+	for _, test := range tests {
+		if got := tplink.LinkSpeed(test.port); got != test.link {
+			t.Errorf("%+v: got link speed %v, want %v", test.port, got, test.link)
+		}
+		if got := tplink.ConfiguredSpeed(test.port); got != test.cfg {
+			t.Errorf("%+v: got configured speed %v, want %v", test.port, got, test.cfg)
+		}
+	}
+}
+
+func TestUnknownSpeedWarnedOnce(t *testing.T) {
+	// forget the warnings of earlier runs, e.g. with -count
+	unknownSpeeds.Range(func(key, _ interface{}) bool {
+		unknownSpeeds.Delete(key)
+		return true
+	})
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	tplink := Tplink{
+		DnsName: "switch",
+		Units:   []Unit{{ID: 1, Data: System{FwVersion: "9.9.9 unknown speeds"}}},
+		Ports:   []Port{{Port: "1/0/1", SpeedLink: 7}, {Port: "1/0/2", SpeedLink: 7}, {Port: "1/0/3", SpeedLink: 3}},
+	}
+	if tplink.LinkSpeed(tplink.Ports[0]) != UnknownSpeed {
+		t.Fatalf("got link speed %v for code 7, want UnknownSpeed", tplink.LinkSpeed(tplink.Ports[0]))
+	}
+	for i := 0; i < 3; i++ {
+		tplink.warnUnknownSpeeds()
+	}
+	if warnings := len(hook.AllEntries()); warnings != 1 {
+		t.Errorf("got %d warnings, want one for code 7", warnings)
+	}
+}
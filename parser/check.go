@@ -0,0 +1,228 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/burningsunrise/tplink-exporter/config"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a mistake found in the configuration file, Line is 0 when it is
+// not tied to a line
+type Problem struct {
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+}
+
+// yamlLine splits the error messages of yaml into the line and the rest
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// unknownField is how yaml.v3 reports a key in strict mode that no field has
+var unknownField = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+
+// ConfigError is returned by LoadConfig when the configuration file has
+// problems
+type ConfigError struct {
+	Path     string
+	Problems []Problem
+}
+
+func (e *ConfigError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.String()
+	}
+	return fmt.Sprintf("%s: %s", e.Path, strings.Join(msgs, "; "))
+}
+
+// CheckConfig validates the configuration file at path with the rules
+// LoadConfig applies and returns every problem found sorted by line. The
+// error is only set when the file cannot be read
+func CheckConfig(path string) ([]Problem, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	_, problems := parseConfig(data)
+	return problems, nil
+}
+
+// parseConfig decodes data strictly and checks it, reporting unknown keys,
+// duplicate devices, invalid hosts and references to missing modules. The
+// configuration can only be used when no problem is returned
+func parseConfig(data []byte) (*YamlConfig, []Problem) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		// a syntax error, nothing below can be trusted
+		return nil, []Problem{yamlProblem(err.Error())}
+	}
+
+	var problems []Problem
+	y := &YamlConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(y)
+	var typeErr *yaml.TypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil, []Problem{{Message: "the file is empty"}}
+	case errors.As(err, &typeErr):
+		for _, msg := range typeErr.Errors {
+			problems = append(problems, yamlProblem(msg))
+		}
+	case err != nil:
+		problems = append(problems, yamlProblem(err.Error()))
+	}
+
+	if len(root.Content) > 0 && root.Content[0].Kind == yaml.MappingNode {
+		if p := checkInterval(root.Content[0]); p != nil {
+			problems = append(problems, *p)
+		}
+		problems = append(problems, checkDevices(root.Content[0])...)
+	}
+	if y.usesDefaultModule() && (y.User == "" || y.Password == "") {
+		// the exporter falls back to the env, so only complain when it is empty too
+		if config.Config("USER") == "" || config.Config("PASSWORD") == "" {
+			problems = append(problems, Problem{Message: "devices use the top level credentials, " +
+				"but user or password is missing and USER or PASSWORD is not set"})
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+	return y, problems
+}
+
+// yamlProblem turns an error message of yaml.v3 into a problem
+func yamlProblem(msg string) Problem {
+	m := yamlLine.FindStringSubmatch(msg)
+	if m == nil {
+		return Problem{Message: strings.TrimPrefix(msg, "yaml: ")}
+	}
+	line, _ := strconv.Atoi(m[1])
+	msg = m[2]
+	if f := unknownField.FindStringSubmatch(msg); f != nil {
+		msg = fmt.Sprintf("unknown key %q", f[1])
+	}
+	return Problem{Line: line, Message: msg}
+}
+
+// checkDevices reports devices without a valid host, hosts configured twice
+// and references to modules or labels that cannot be used
+func checkDevices(root *yaml.Node) []Problem {
+	modules := map[string]bool{DefaultModule: true}
+	if node := mappingValue(root, "modules"); node != nil && node.Kind == yaml.MappingNode {
+		for i := 0; i < len(node.Content); i += 2 {
+			modules[node.Content[i].Value] = true
+		}
+	}
+	devices := mappingValue(root, "devices")
+	if devices == nil || len(devices.Content) == 0 {
+		return []Problem{{Message: "no devices configured"}}
+	}
+	if devices.Kind != yaml.SequenceNode {
+		// already reported by the decoder
+		return nil
+	}
+
+	var problems []Problem
+	seen := map[string]int{}
+	for _, device := range devices.Content {
+		host := device
+		if device.Kind == yaml.MappingNode {
+			host = mappingValue(device, "host")
+			if p := checkInterval(device); p != nil {
+				problems = append(problems, *p)
+			}
+			if module := mappingValue(device, "module"); module != nil && !modules[module.Value] && module.Value != "" {
+				problems = append(problems, Problem{module.Line, fmt.Sprintf("unknown module %q", module.Value)})
+			}
+			if labels := mappingValue(device, "labels"); labels != nil && labels.Kind == yaml.MappingNode {
+				for i := 0; i < len(labels.Content); i += 2 {
+					if err := checkLabelName(labels.Content[i].Value); err != nil {
+						problems = append(problems, Problem{labels.Content[i].Line, err.Error()})
+					}
+				}
+			}
+		}
+		if host == nil || host.Kind != yaml.ScalarNode || host.Value == "" {
+			problems = append(problems, Problem{device.Line, "device without a host"})
+			continue
+		}
+		if err := checkHost(host.Value); err != nil {
+			problems = append(problems, Problem{host.Line, err.Error()})
+		}
+		if line, ok := seen[host.Value]; ok {
+			problems = append(problems, Problem{host.Line,
+				fmt.Sprintf("duplicate device %q, first configured on line %d", host.Value, line)})
+			continue
+		}
+		seen[host.Value] = host.Line
+	}
+	return problems
+}
+
+// checkInterval reports an interval in node shorter than MinInterval,
+// intervals that are not durations are reported by the decoder
+func checkInterval(node *yaml.Node) *Problem {
+	interval := mappingValue(node, "interval")
+	if interval == nil {
+		return nil
+	}
+	d, err := time.ParseDuration(interval.Value)
+	if err != nil || d >= MinInterval {
+		return nil
+	}
+	return &Problem{interval.Line, fmt.Sprintf("interval %s is shorter than %s", interval.Value, MinInterval)}
+}
+
+// mappingValue returns the value of key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+var hostname = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*\.?$`)
+
+// checkHost returns an error when host is neither an IP address nor a
+// hostname, either may be followed by a port
+func checkHost(host string) error {
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port in host %q", host)
+		}
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if _, err := strconv.Atoi(labels[len(labels)-1]); err == nil || len(host) > 253 || !hostname.MatchString(host) {
+		// a numeric top level domain is a mistyped IP address
+		return fmt.Errorf("%q is neither an IP address nor a valid hostname", host)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package parser
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/burningsunrise/tplink-exporter/config"
+)
+
+func TestCheckConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, `user: admin
+password: secret
+interval: soon
+device: typo
+devices:
+  - 10.1.1.2
+  - switch-1.example.com
+  - 10.1.1.2
+  - 10.1.1.300
+  - bad_host.example.com
+  - host: lab.example.com:8443
+    module: lab
+    labels:
+      port: a1
+  - host: core.example.com
+    interval: 5 minutes
+    colour: blue
+  - module: core
+  - host: access.example.com
+    interval: 10ms
+  - host: edge.example.com
+    interval: 60
+modules:
+  core:
+    user: core
+    password: secret
+`)
+	problems, err := CheckConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Problem{
+		{3, "cannot unmarshal !!str `soon` into time.Duration"},
+		{4, `unknown key "device"`},
+		{8, `duplicate device "10.1.1.2", first configured on line 6`},
+		{9, `"10.1.1.300" is neither an IP address nor a valid hostname`},
+		{10, `"bad_host.example.com" is neither an IP address nor a valid hostname`},
+		{12, `unknown module "lab"`},
+		{14, `label "port" is already used by the exporter`},
+		{16, "cannot unmarshal !!str `5 minutes` into time.Duration"},
+		{17, `unknown key "colour"`},
+		{18, "device without a host"},
+		{20, "interval 10ms is shorter than 1s"},
+		{22, "cannot unmarshal !!int `60` into time.Duration"},
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("got problems\n%v\nwant\n%v", problems, want)
+	}
+}
+
+func TestCheckConfigValid(t *testing.T) {
+	t.Setenv("USER", "")
+	t.Setenv("PASSWORD", "")
+	envFile := config.EnvFile
+	t.Cleanup(func() { config.EnvFile = envFile })
+	config.EnvFile = filepath.Join(t.TempDir(), ".env")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	writeConfig(t, path, "devices:\n  - host: 10.1.1.2\n    module: core\nmodules:\n  core:\n    user: a\n    password: b\n")
+	if problems, err := CheckConfig(path); err != nil || len(problems) != 0 {
+		t.Errorf("got %v, %v for a valid config", problems, err)
+	}
+
+	for name, content := range map[string]string{
+		"syntax error":   "devices: [10.1.1.2\n",
+		"duplicate key":  "user: a\npassword: b\nuser: c\ndevices:\n  - 10.1.1.2\n",
+		"no credentials": "devices:\n  - 10.1.1.2\n",
+		"no devices":     "user: a\npassword: b\n",
+		"empty":          "",
+	} {
+		writeConfig(t, path, content)
+		if problems, err := CheckConfig(path); err != nil || len(problems) != 1 {
+			t.Errorf("%s: got %v, %v, want one problem", name, problems, err)
+		}
+	}
+}
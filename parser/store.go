@@ -0,0 +1,46 @@
+package parser
+
+import "sync"
+
+// ConfigStore holds the configuration in use. It is loaded and validated once
+// and only replaced by a reload that succeeds, so a half edited file never
+// takes effect
+type ConfigStore struct {
+	path    string
+	mu      sync.RWMutex
+	current *YamlConfig
+}
+
+// NewConfigStore loads the configuration file at path
+func NewConfigStore(path string) (*ConfigStore, error) {
+	y, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigStore{path: path, current: y}, nil
+}
+
+// Path returns the path of the configuration file
+func (s *ConfigStore) Path() string {
+	return s.path
+}
+
+// Get returns the configuration in use, it must not be modified
+func (s *ConfigStore) Get() *YamlConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// Reload reads the configuration file again, when it cannot be loaded the
+// error is returned and the previous configuration stays in use
+func (s *ConfigStore) Reload() error {
+	y, err := LoadConfig(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = y
+	return nil
+}
@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/burningsunrise/tplink-exporter/config"
+)
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("USER", "")
+	t.Setenv("PASSWORD", "")
+	envFile := config.EnvFile
+	t.Cleanup(func() { config.EnvFile = envFile })
+	config.EnvFile = filepath.Join(t.TempDir(), ".env")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	writeConfig(t, path, "user: admin\npassword: secret\ndevices:\n  - 10.1.1.2\n")
+	y, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if y.Interval != DefaultInterval || y.PoolSize != DefaultPoolSize || y.Devices[0].Interval != DefaultInterval {
+		t.Errorf("defaults not applied: %+v", y)
+	}
+
+	for name, content := range map[string]string{
+		"no devices":       "user: admin\npassword: secret\n",
+		"no credentials":   "devices:\n  - 10.1.1.2\n",
+		"unknown module":   "user: admin\npassword: secret\ndevices:\n  - host: 10.1.1.2\n    module: lab\n",
+		"reserved label":   "user: admin\npassword: secret\ndevices:\n  - host: 10.1.1.2\n    labels:\n      port: a\n",
+		"invalid yaml":     "devices: [10.1.1.2\n",
+		"invalid interval": "user: admin\npassword: secret\ninterval: soon\ndevices:\n  - 10.1.1.2\n",
+		"short interval":   "user: admin\npassword: secret\ninterval: 100ms\ndevices:\n  - 10.1.1.2\n",
+		"integer interval": "user: admin\npassword: secret\ninterval: 60\ndevices:\n  - 10.1.1.2\n",
+		"unknown key":      "user: admin\npassword: secret\ndevices:\n  - 10.1.1.2\ndevice: 10.1.1.3\n",
+		"duplicate device": "user: admin\npassword: secret\ndevices:\n  - 10.1.1.2\n  - 10.1.1.2\n",
+		"invalid host":     "user: admin\npassword: secret\ndevices:\n  - 10.1.1.300\n",
+	} {
+		writeConfig(t, path, content)
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+	// startup reports the same problems as check-config
+	writeConfig(t, path, "user: admin\npassword: secret\ndevices:\n  - 10.1.1.2\n  - 10.1.1.2\n")
+	_, err = LoadConfig(path)
+	problems, _ := CheckConfig(path)
+	want := &ConfigError{Path: path, Problems: problems}
+	if len(problems) != 1 || err == nil || err.Error() != want.Error() {
+		t.Errorf("got %v, want %v", err, want)
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file: got no error")
+	}
+}
+
+func TestConfigStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "user: admin\npassword: secret\ndevices:\n  - 10.1.1.2\n")
+	store, err := NewConfigStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig(t, path, "user: admin\npassword: secret\ninterval: 30s\ndevices:\n  - 10.1.1.2\n  - 10.1.1.3\n")
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if y := store.Get(); len(y.Devices) != 2 || y.Interval != 30*time.Second {
+		t.Errorf("reload not applied: %+v", y)
+	}
+
+	// a half edited file keeps the previous configuration
+	writeConfig(t, path, "user: admin\npassword: secret\ndevice")
+	if err := store.Reload(); err == nil {
+		t.Error("got no error for a broken file")
+	}
+	if y := store.Get(); len(y.Devices) != 2 {
+		t.Errorf("got %d devices after a failed reload, want 2", len(y.Devices))
+	}
+}
@@ -1,45 +1,189 @@
 package parser
 
 import (
+	"fmt"
 	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/burningsunrise/tplink-exporter/config"
 
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
 )
 
+// DefaultModule is the module name used when a probe does not ask for one,
+// it maps to the top level user and password
+const DefaultModule = "default"
+
+// DefaultInterval is how often devices are polled when no interval is configured
+const DefaultInterval = 60 * time.Second
+
+// MinInterval is the shortest poll interval a configuration may set
+const MinInterval = time.Second
+
+// DefaultPoolSize is how many devices are probed at once when pool_size is
+// not configured
+const DefaultPoolSize = 20
+
+// DefaultConfigFile is the configuration file read when no path is given
+const DefaultConfigFile = "config.yaml"
+
+// DefaultMaxRequests is how many requests are sent to a switch at once when
+// max_requests is not configured
+const DefaultMaxRequests = 4
+
 type YamlConfig struct {
-	User     string   `yaml:"user"`
-	Password string   `yaml:"password"`
-	Devices  []string `yaml:",flow"`
+	User        string            `yaml:"user"`
+	Password    string            `yaml:"password"`
+	Devices     []Device          `yaml:"devices"`
+	Modules     map[string]Module `yaml:"modules"`
+	Interval    time.Duration     `yaml:"interval"`
+	MaxRequests int               `yaml:"max_requests"`
+	PoolSize    int               `yaml:"pool_size"`
 }
 
-func (y *YamlConfig) GetConfig() *YamlConfig {
-	yamlFile, err := ioutil.ReadFile("config.yaml")
-	if err != nil {
-		log.Printf("yamlFile.Get err   #%v ", err)
+// Device is a switch polled in the background, it is written either as just
+// the host or as an object. Module names the credentials used to log in,
+// labels are added to every metric of the device. Devices with a higher
+// priority are polled first when every worker is busy, interval and
+// max_requests default to the top level ones
+type Device struct {
+	Host        string            `yaml:"host"`
+	Module      string            `yaml:"module"`
+	Labels      map[string]string `yaml:"labels"`
+	Interval    time.Duration     `yaml:"interval"`
+	Priority    int               `yaml:"priority"`
+	MaxRequests int               `yaml:"max_requests"`
+}
+
+func (d *Device) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&d.Host); err == nil {
+		return nil
 	}
-	err = yaml.Unmarshal(yamlFile, &y)
+	// the alias has no UnmarshalYAML method, so this does not recurse
+	type device Device
+	return unmarshal((*device)(d))
+}
+
+// Module holds the credentials used to log in to a switch probed through
+// /probe and how many requests may be sent to it at once
+type Module struct {
+	User        string `yaml:"user"`
+	Password    string `yaml:"password"`
+	MaxRequests int    `yaml:"max_requests"`
+}
+
+// LoadConfig reads the configuration file at path, checks it with the rules
+// of check-config and fills in the defaults. Missing top level credentials
+// are read from the USER and PASSWORD env variables
+func LoadConfig(path string) (*YamlConfig, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
+		return nil, err
 	}
-	if len(y.Devices) <= 0 {
-		log.WithFields(log.Fields{
-			"devices": "missing",
-		}).Fatal("you must add devices in a list in a yaml file")
+	y, problems := parseConfig(data)
+	if len(problems) > 0 {
+		return nil, &ConfigError{Path: path, Problems: problems}
+	}
+	if y.Interval <= 0 {
+		y.Interval = DefaultInterval
+	}
+	if y.MaxRequests <= 0 {
+		y.MaxRequests = DefaultMaxRequests
+	}
+	if y.PoolSize <= 0 {
+		y.PoolSize = DefaultPoolSize
 	}
-	if y.Password == "" || y.User == "" {
+	for i := range y.Devices {
+		if y.Devices[i].Interval <= 0 {
+			y.Devices[i].Interval = y.Interval
+		}
+	}
+	if y.usesDefaultModule() && (y.Password == "" || y.User == "") {
 		log.WithFields(log.Fields{
 			"yaml": "incomplete",
 		}).Info("password or username missing from yaml file, trying .env")
 		y.Password = config.Config("PASSWORD")
 		y.User = config.Config("USER")
-		if y.Password == "" || y.User == "" {
-			log.WithFields(log.Fields{
-				"credentials": "missing",
-			}).Fatal("you must either add a user / password key in a yaml file or add USER and PASSWORD env viarables")
+	}
+	return y, nil
+}
+
+// Module looks up a module by name, an empty name or "default" returns the
+// top level credentials unless a module named "default" has been configured.
+// Modules without max_requests inherit the top level one
+func (y *YamlConfig) Module(name string) (Module, error) {
+	if name == "" {
+		name = DefaultModule
+	}
+	if m, ok := y.Modules[name]; ok {
+		if m.MaxRequests <= 0 {
+			m.MaxRequests = y.MaxRequests
+		}
+		return m, nil
+	}
+	if name == DefaultModule {
+		return Module{User: y.User, Password: y.Password, MaxRequests: y.MaxRequests}, nil
+	}
+	return Module{}, fmt.Errorf("unknown module %q", name)
+}
+
+// usesDefaultModule reports whether a device logs in with the top level
+// credentials
+func (y *YamlConfig) usesDefaultModule() bool {
+	if _, ok := y.Modules[DefaultModule]; ok {
+		return false
+	}
+	for _, device := range y.Devices {
+		if device.Module == "" || device.Module == DefaultModule {
+			return true
+		}
+	}
+	return false
+}
+
+// Device returns the configured device with the given host
+func (y *YamlConfig) Device(host string) (Device, bool) {
+	for _, device := range y.Devices {
+		if device.Host == host {
+			return device, true
 		}
 	}
-	return y
+	return Device{}, false
+}
+
+// DeviceModule returns the module a device logs in with, with the options of
+// the device applied
+func (y *YamlConfig) DeviceModule(d Device) (Module, error) {
+	m, err := y.Module(d.Module)
+	if err != nil {
+		return Module{}, err
+	}
+	if d.MaxRequests > 0 {
+		m.MaxRequests = d.MaxRequests
+	}
+	return m, nil
+}
+
+// reservedLabels are the label names of the exporters own metrics, devices
+// cannot use them
+var reservedLabels = map[string]bool{
+	"host": true, "unit": true, "slot": true, "port": true, "direction": true, "type": true,
+	"size": true, "duplex": true, "configured": true, "media": true, "vlan_id": true,
+	"vlan_name": true, "description": true, "location": true, "hardware_version": true,
+	"firmware_version": true, "mac_address": true, "serial_number": true, "stage": true,
+}
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// checkLabelName returns an error when name cannot be used as a device label
+func checkLabelName(name string) error {
+	switch {
+	case !labelName.MatchString(name) || strings.HasPrefix(name, "__"):
+		return fmt.Errorf("%q is not a valid label name", name)
+	case reservedLabels[name]:
+		return fmt.Errorf("label %q is already used by the exporter", name)
+	}
+	return nil
 }
@@ -0,0 +1,55 @@
+package parser
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestDevices(t *testing.T) {
+	var y YamlConfig
+	err := yaml.Unmarshal([]byte(`
+user: admin
+password: secret
+max_requests: 2
+devices:
+  - 192.168.0.10
+  - host: lab-switch
+    module: lab
+    max_requests: 1
+    labels:
+      site: lab
+      rack: r1
+modules:
+  lab:
+    user: lab
+    password: other
+`), &y)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(y.Devices) != 2 || y.Devices[0].Host != "192.168.0.10" || y.Devices[1].Host != "lab-switch" {
+		t.Fatalf("got devices %+v", y.Devices)
+	}
+
+	m, err := y.DeviceModule(y.Devices[0])
+	if err != nil || m != (Module{User: "admin", Password: "secret", MaxRequests: 2}) {
+		t.Errorf("got module %+v, %v for a flat device", m, err)
+	}
+	m, err = y.DeviceModule(y.Devices[1])
+	if err != nil || m != (Module{User: "lab", Password: "other", MaxRequests: 1}) {
+		t.Errorf("got module %+v, %v for lab-switch", m, err)
+	}
+	if _, err := y.DeviceModule(Device{Host: "other", Module: "missing"}); err == nil {
+		t.Error("got no error for an unknown module")
+	}
+}
+
+func TestCheckLabelName(t *testing.T) {
+	for name, valid := range map[string]bool{"site": true, "rack_2": true, "host": false, "port": false,
+		"2rack": false, "__meta": false, "my-label": false} {
+		if err := checkLabelName(name); (err == nil) != valid {
+			t.Errorf("%q: got error %v", name, err)
+		}
+	}
+}